@@ -0,0 +1,104 @@
+package apiserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Broker delivers PacketOut payloads between server nodes, they are opaque to it.
+// Adapters for Redis, NATS etc implement it outside of this package.
+type Broker interface {
+	Publish(channel string, payload []byte) error
+	// Subscribe calls handler for every payload published to channel on any node until cancel is called
+	Subscribe(channel string, handler func(payload []byte)) (cancel func(), err error)
+}
+
+const broadcastChannel = `broadcast`
+
+func topicChannel(topic string) string {
+	return `topic:` + topic
+}
+
+// brokerMessage is published to Broker, publisher skips its own messages as it delivers them locally.
+// Packet is encoded by MsgpackCodec, which keeps bytes apart from strings, other nodes send it
+// as it is to msgpack connections and re-encode it once per codec for others.
+type brokerMessage struct {
+	Origin string             `msgpack:"origin"`
+	Packet msgpack.RawMessage `msgpack:"packet"`
+}
+
+// newOrigin identifies publisher among nodes sharing Broker
+func newOrigin() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func encodeBrokerMessage(origin string, packet *encodedPacket) []byte {
+	buf, _ := msgpack.Marshal(brokerMessage{
+		Origin: origin,
+		Packet: packet.encode(MsgpackCodec),
+	})
+	return buf
+}
+
+// decodeBrokerMessage returns nil packet for messages of origin and broken ones
+func decodeBrokerMessage(origin string, payload []byte) *encodedPacket {
+	var msg brokerMessage
+	if err := msgpack.Unmarshal(payload, &msg); err != nil || msg.Origin == origin || len(msg.Packet) == 0 {
+		return nil
+	}
+	return &encodedPacket{
+		bufs: map[string][]byte{MsgpackCodec.Subprotocol(): msg.Packet},
+	}
+}
+
+// MemoryBroker is a Broker for nodes living in one process
+type MemoryBroker struct {
+	mu       sync.RWMutex
+	lastID   uint64
+	handlers map[string]map[uint64]func(payload []byte)
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		handlers: make(map[string]map[uint64]func(payload []byte)),
+	}
+}
+
+func (self *MemoryBroker) Publish(channel string, payload []byte) error {
+	self.mu.RLock()
+	handlers := make([]func(payload []byte), 0, len(self.handlers[channel]))
+	for _, handler := range self.handlers[channel] {
+		handlers = append(handlers, handler)
+	}
+	self.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(payload)
+	}
+	return nil
+}
+
+func (self *MemoryBroker) Subscribe(channel string, handler func(payload []byte)) (func(), error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.lastID++
+	id := self.lastID
+	if self.handlers[channel] == nil {
+		self.handlers[channel] = make(map[uint64]func(payload []byte))
+	}
+	self.handlers[channel][id] = handler
+	return func() {
+		self.mu.Lock()
+		defer self.mu.Unlock()
+		delete(self.handlers[channel], id)
+		if len(self.handlers[channel]) == 0 {
+			delete(self.handlers, channel)
+		}
+	}, nil
+}
@@ -0,0 +1,112 @@
+package apiserver_test
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/x12tech/go-websocketapi/apiserver"
+)
+
+// testNode is one server of a cluster sharing a broker
+type testNode struct {
+	server     *apiserver.Server
+	pubsub     *apiserver.PubSub
+	httpserver *http.Server
+	port       int
+}
+
+func startNode(broker apiserver.Broker) *testNode {
+	node := &testNode{
+		pubsub: apiserver.NewPubSub(),
+	}
+	node.pubsub.SetBroker(broker)
+	router := apiserver.NewRouter()
+	node.pubsub.Register(router, 0)
+	node.server, node.httpserver, node.port = startServer(apiserver.ServerOpts{
+		Router: router,
+		PubSub: node.pubsub,
+		Broker: broker,
+	})
+	return node
+}
+
+func (self *testNode) Connect() *ApiClient {
+	c, err := Dial(`127.0.0.1:` + strconv.Itoa(self.port))
+	Expect(err).To(Succeed())
+	return c
+}
+
+func (self *testNode) Stop() {
+	self.server.Shutdown(context.Background())
+	self.httpserver.Shutdown(context.Background())
+}
+
+type blob struct {
+	Data []byte `json:"data"`
+}
+
+func (blob) CmdName() string {
+	return `Blob`
+}
+
+var _ = Describe("broker", func() {
+	var (
+		broker *apiserver.MemoryBroker
+		nodeA  *testNode
+		nodeB  *testNode
+	)
+	BeforeEach(func() {
+		broker = apiserver.NewMemoryBroker()
+		nodeA = startNode(broker)
+		nodeB = startNode(broker)
+	})
+	AfterEach(func() {
+		nodeA.Stop()
+		nodeB.Stop()
+	})
+	It(`delivers topic publishes across nodes`, func() {
+		onA := nodeA.Connect()
+		onB := nodeB.Connect()
+		for _, c := range []*ApiClient{onA, onB} {
+			Expect(c.Send([]byte(`{ "cid": 1, "cmds":[{ "name" : "Subscribe", "data" : { "topic" : "news" } }]}`))).To(Succeed())
+			Expect(c.Await()).To(MatchJSON(`{ "cid": 1, "cmds":[{ "name" : "Subscribed", "data" : { "topic" : "news" } }]}`))
+		}
+		Expect(nodeB.pubsub.Publish(`news`, StillAlive{Ping: `from B`})).To(Equal(1))
+		Expect(onA.Await()).To(MatchJSON(`{ "cmds": [{  "name" : "StillAlive", "data":{"ping":"from B"} }]}`))
+		Expect(onB.Await()).To(MatchJSON(`{ "cmds": [{  "name" : "StillAlive", "data":{"ping":"from B"} }]}`))
+
+		Expect(onA.Send([]byte(`{ "cid": 2, "cmds":[{ "name" : "Unsubscribe", "data" : { "topic" : "news" } }]}`))).To(Succeed())
+		Expect(onA.Await()).To(MatchJSON(`{ "cid": 2, "cmds":[{ "name" : "Unsubscribed", "data" : { "topic" : "news" } }]}`))
+		Expect(nodeA.pubsub.Publish(`news`, StillAlive{Ping: `from A`})).To(Equal(0))
+		Expect(onB.Await()).To(MatchJSON(`{ "cmds": [{  "name" : "StillAlive", "data":{"ping":"from A"} }]}`))
+		onA.ws.Close()
+		onB.ws.Close()
+	})
+	It(`delivers publishes of other node encoded by connection codec from typed commands`, func() {
+		onA := DialProtocol(`127.0.0.1:`+strconv.Itoa(nodeA.port), `msgpack`)
+		defer onA.ws.Close()
+		Expect(onA.Send(encodeMsgpack(testPacket(1, `Subscribe`, map[string]interface{}{`topic`: `blobs`})))).To(Succeed())
+		_, err := onA.Await()
+		Expect(err).To(Succeed())
+		Expect(nodeB.pubsub.Publish(`blobs`, blob{Data: []byte{1, 2, 3}})).To(Equal(0))
+		expected, err := apiserver.MsgpackCodec.EncodePacket(&apiserver.PacketOut{
+			Commands: []apiserver.CommandOut{{Name: `Blob`, Data: blob{Data: []byte{1, 2, 3}}}},
+		})
+		Expect(err).To(Succeed())
+		// bytes stay msgpack bin instead of base64 string JSON would turn them into
+		Expect(onA.Await()).To(Equal(expected))
+	})
+	It(`broadcasts across nodes`, func() {
+		onA := nodeA.Connect()
+		onB := nodeB.Connect()
+		Eventually(nodeB.server.Count).Should(Equal(1))
+		Expect(nodeA.server.BroadcastAll(StillAlive{Ping: `everyone`})).To(Succeed())
+		Expect(onA.Await()).To(MatchJSON(`{ "cmds": [{  "name" : "StillAlive", "data":{"ping":"everyone"} }]}`))
+		Expect(onB.Await()).To(MatchJSON(`{ "cmds": [{  "name" : "StillAlive", "data":{"ping":"everyone"} }]}`))
+		onA.ws.Close()
+		onB.ws.Close()
+	})
+})
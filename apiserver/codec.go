@@ -0,0 +1,110 @@
+package apiserver
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes packets and decodes command data of a connection.
+// It is chosen by websocket subprotocol offered by client, JSONCodec is used if none matches.
+type Codec interface {
+	// Subprotocol is websocket subprotocol name selecting this codec
+	Subprotocol() string
+	// Binary codecs are sent in binary frames, others in text frames
+	Binary() bool
+	// DecodePacket leaves CommandIn.Data raw to be decoded by DecodeData into handler input
+	DecodePacket(buf []byte) (*PacketIn, error)
+	DecodeData(data []byte, v interface{}) error
+	// DecodeDataStrict rejects data with fields unknown to v, see Router.EnableStrictDecoding
+	DecodeDataStrict(data []byte, v interface{}) error
+	EncodePacket(packet *PacketOut) ([]byte, error)
+}
+
+var (
+	JSONCodec    Codec = jsonCodec{}
+	MsgpackCodec Codec = msgpackCodec{}
+	CBORCodec    Codec = cborCodec{}
+)
+
+// DefaultCodecs are offered by Server when ServerOpts.Codecs is empty
+var DefaultCodecs = []Codec{JSONCodec, MsgpackCodec, CBORCodec, ProtobufCodec}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Subprotocol() string {
+	return `json`
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+func (jsonCodec) DecodePacket(buf []byte) (*PacketIn, error) {
+	var packet *PacketIn
+	if err := json.Unmarshal(buf, &packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+func (jsonCodec) DecodeData(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) DecodeDataStrict(data []byte, v interface{}) error {
+	return decodeStrict(data, v)
+}
+
+func (jsonCodec) EncodePacket(packet *PacketOut) ([]byte, error) {
+	return json.Marshal(packet)
+}
+
+// codecOf picks the first subprotocol offered by client which has a codec
+func codecOf(codecs []Codec, protocols []string) (Codec, bool) {
+	for _, protocol := range protocols {
+		for _, codec := range codecs {
+			if codec.Subprotocol() == protocol {
+				return codec, true
+			}
+		}
+	}
+	return JSONCodec, false
+}
+
+// encodedPacket encodes packet once for every codec of connections it is sent to
+type encodedPacket struct {
+	packet *PacketOut
+	bufs   map[string][]byte
+}
+
+func newEncodedPacket(packet PacketOut) *encodedPacket {
+	return &encodedPacket{
+		packet: &packet,
+		bufs:   make(map[string][]byte),
+	}
+}
+
+func (self *encodedPacket) encode(codec Codec) []byte {
+	if buf, ok := self.bufs[codec.Subprotocol()]; ok {
+		return buf
+	}
+	buf := marshallPacket(codec, *self.decoded())
+	self.bufs[codec.Subprotocol()] = buf
+	return buf
+}
+
+// decoded returns packet itself, it is decoded from msgpack with untyped command data if it came from Broker
+func (self *encodedPacket) decoded() *PacketOut {
+	if self.packet == nil {
+		var packet PacketOut
+		dec := msgpack.NewDecoder(bytes.NewReader(self.bufs[MsgpackCodec.Subprotocol()]))
+		dec.SetCustomStructTag(`json`)
+		if err := dec.Decode(&packet); err != nil {
+			packet = PacketOut{Commands: apiErrorCommands(`internal_error`, err.Error())}
+		}
+		self.packet = &packet
+	}
+	return self.packet
+}
@@ -0,0 +1,70 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// cborCodec falls back to json struct tags when there is no cbor tag
+type cborCodec struct{}
+
+type cborCommandIn struct {
+	Name string          `cbor:"name"`
+	Data cbor.RawMessage `cbor:"data"`
+}
+
+type cborPacketIn struct {
+	Commands []cborCommandIn `cbor:"cmds"`
+	Cid      int32           `cbor:"cid"`
+}
+
+var (
+	cborDecMode, _ = cbor.DecOptions{
+		DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+	}.DecMode()
+	cborStrictDecMode, _ = cbor.DecOptions{
+		DefaultMapType:    reflect.TypeOf(map[string]interface{}(nil)),
+		ExtraReturnErrors: cbor.ExtraDecErrorUnknownField,
+	}.DecMode()
+)
+
+func (cborCodec) Subprotocol() string {
+	return `cbor`
+}
+
+func (cborCodec) Binary() bool {
+	return true
+}
+
+func (cborCodec) DecodePacket(buf []byte) (*PacketIn, error) {
+	var in cborPacketIn
+	if err := cborDecMode.Unmarshal(buf, &in); err != nil {
+		return nil, err
+	}
+	packet := &PacketIn{
+		Cid:      in.Cid,
+		Commands: make([]CommandIn, 0, len(in.Commands)),
+	}
+	for _, cmd := range in.Commands {
+		packet.Commands = append(packet.Commands, CommandIn{Name: cmd.Name, Data: json.RawMessage(cmd.Data)})
+	}
+	return packet, nil
+}
+
+func (cborCodec) DecodeData(data []byte, v interface{}) error {
+	return cborDecMode.Unmarshal(data, v)
+}
+
+func (cborCodec) DecodeDataStrict(data []byte, v interface{}) error {
+	err := cborStrictDecMode.Unmarshal(data, v)
+	if unknown, ok := err.(*cbor.UnknownFieldError); ok {
+		return ApiError(`unknown_field`, unknown.Error())
+	}
+	return err
+}
+
+func (cborCodec) EncodePacket(packet *PacketOut) ([]byte, error) {
+	return cbor.Marshal(packet)
+}
@@ -0,0 +1,75 @@
+package apiserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// msgpackCodec reads json struct tags, so the same types serve both encodings
+type msgpackCodec struct{}
+
+type msgpackCommandIn struct {
+	Name string             `msgpack:"name"`
+	Data msgpack.RawMessage `msgpack:"data"`
+}
+
+type msgpackPacketIn struct {
+	Commands []msgpackCommandIn `msgpack:"cmds"`
+	Cid      int32              `msgpack:"cid"`
+}
+
+func (msgpackCodec) Subprotocol() string {
+	return `msgpack`
+}
+
+func (msgpackCodec) Binary() bool {
+	return true
+}
+
+func (msgpackCodec) DecodePacket(buf []byte) (*PacketIn, error) {
+	var in msgpackPacketIn
+	if err := msgpack.Unmarshal(buf, &in); err != nil {
+		return nil, err
+	}
+	packet := &PacketIn{
+		Cid:      in.Cid,
+		Commands: make([]CommandIn, 0, len(in.Commands)),
+	}
+	for _, cmd := range in.Commands {
+		packet.Commands = append(packet.Commands, CommandIn{Name: cmd.Name, Data: json.RawMessage(cmd.Data)})
+	}
+	return packet, nil
+}
+
+func (self msgpackCodec) DecodeData(data []byte, v interface{}) error {
+	return self.decode(data, v, false)
+}
+
+func (self msgpackCodec) DecodeDataStrict(data []byte, v interface{}) error {
+	err := self.decode(data, v, true)
+	if err != nil && strings.HasPrefix(err.Error(), `msgpack: unknown field `) {
+		return ApiError(`unknown_field`, strings.TrimPrefix(err.Error(), `msgpack: `))
+	}
+	return err
+}
+
+func (msgpackCodec) decode(data []byte, v interface{}, strict bool) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag(`json`)
+	dec.DisallowUnknownFields(strict)
+	return dec.Decode(v)
+}
+
+func (msgpackCodec) EncodePacket(packet *PacketOut) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag(`json`)
+	enc.UseCompactInts(true)
+	if err := enc.Encode(packet); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
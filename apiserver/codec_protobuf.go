@@ -0,0 +1,176 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// ProtobufCodec sends packets in envelope described by Router.DescribeProto.
+// Command data is proto.Message when handler takes or returns one,
+// any other data is sent as google.protobuf.Struct.
+var ProtobufCodec Codec = protobufCodec{}
+
+type protobufCodec struct{}
+
+// field numbers of envelope messages, see protoEnvelope
+const (
+	protoPacketCid      = 1
+	protoPacketCommands = 2
+	protoCommandName    = 1
+	protoCommandData    = 2
+)
+
+func (protobufCodec) Subprotocol() string {
+	return `protobuf`
+}
+
+func (protobufCodec) Binary() bool {
+	return true
+}
+
+func (protobufCodec) DecodePacket(buf []byte) (*PacketIn, error) {
+	packet := &PacketIn{}
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		buf = buf[n:]
+		switch {
+		case num == protoPacketCid && typ == protowire.VarintType:
+			var cid uint64
+			cid, n = protowire.ConsumeVarint(buf)
+			packet.Cid = int32(cid)
+		case num == protoPacketCommands && typ == protowire.BytesType:
+			var cmdBuf []byte
+			cmdBuf, n = protowire.ConsumeBytes(buf)
+			if n >= 0 {
+				cmd, err := decodeProtoCommand(cmdBuf)
+				if err != nil {
+					return nil, err
+				}
+				packet.Commands = append(packet.Commands, cmd)
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, buf)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		buf = buf[n:]
+	}
+	return packet, nil
+}
+
+func decodeProtoCommand(buf []byte) (CommandIn, error) {
+	var cmd CommandIn
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return cmd, protowire.ParseError(n)
+		}
+		buf = buf[n:]
+		switch {
+		case num == protoCommandName && typ == protowire.BytesType:
+			cmd.Name, n = protowire.ConsumeString(buf)
+		case num == protoCommandData && typ == protowire.BytesType:
+			var data []byte
+			data, n = protowire.ConsumeBytes(buf)
+			cmd.Data = data
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, buf)
+		}
+		if n < 0 {
+			return cmd, protowire.ParseError(n)
+		}
+		buf = buf[n:]
+	}
+	return cmd, nil
+}
+
+func (protobufCodec) DecodeData(data []byte, v interface{}) error {
+	if msg, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, msg)
+	}
+	buf, err := structToJSON(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+func (protobufCodec) DecodeDataStrict(data []byte, v interface{}) error {
+	if msg, ok := v.(proto.Message); ok {
+		if err := proto.Unmarshal(data, msg); err != nil {
+			return err
+		}
+		if unknown := msg.ProtoReflect().GetUnknown(); len(unknown) > 0 {
+			num, _, _ := protowire.ConsumeTag(unknown)
+			return ApiError(`unknown_field`, `unknown field `+strconv.Itoa(int(num)))
+		}
+		return nil
+	}
+	buf, err := structToJSON(data)
+	if err != nil {
+		return err
+	}
+	return decodeStrict(buf, v)
+}
+
+func structToJSON(data []byte) ([]byte, error) {
+	s := &structpb.Struct{}
+	if err := proto.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return json.Marshal(s.AsMap())
+}
+
+func (protobufCodec) EncodePacket(packet *PacketOut) ([]byte, error) {
+	var buf []byte
+	if packet.Cid != 0 {
+		buf = protowire.AppendTag(buf, protoPacketCid, protowire.VarintType)
+		buf = protowire.AppendVarint(buf, uint64(int64(packet.Cid)))
+	}
+	for _, cmd := range packet.Commands {
+		data, err := encodeProtoData(cmd.Data)
+		if err != nil {
+			return nil, errors.Wrap(err, cmd.Name)
+		}
+		cmdBuf := protowire.AppendTag(nil, protoCommandName, protowire.BytesType)
+		cmdBuf = protowire.AppendString(cmdBuf, cmd.Name)
+		if len(data) > 0 {
+			cmdBuf = protowire.AppendTag(cmdBuf, protoCommandData, protowire.BytesType)
+			cmdBuf = protowire.AppendBytes(cmdBuf, data)
+		}
+		buf = protowire.AppendTag(buf, protoPacketCommands, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, cmdBuf)
+	}
+	return buf, nil
+}
+
+func encodeProtoData(v interface{}) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if msg, ok := v.(proto.Message); ok {
+		return proto.Marshal(msg)
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return nil, errors.New(`data which is not proto.Message must be an object`)
+	}
+	s, err := structpb.NewStruct(fields)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(s)
+}
@@ -0,0 +1,142 @@
+package apiserver_test
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+
+	"github.com/fxamacker/cbor/v2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/x12tech/go-websocketapi/apiserver"
+	"golang.org/x/net/websocket"
+)
+
+type testReplyCommand struct {
+	Name string                 `json:"name"`
+	Data map[string]interface{} `json:"data"`
+}
+
+type testReply struct {
+	Cid  int32              `json:"cid"`
+	Cmds []testReplyCommand `json:"cmds"`
+}
+
+func testPacket(cid int, name string, data map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		`cid`:  cid,
+		`cmds`: []interface{}{map[string]interface{}{`name`: name, `data`: data}},
+	}
+}
+
+func encodeMsgpack(v interface{}) []byte {
+	buf, err := msgpack.Marshal(v)
+	Expect(err).To(Succeed())
+	return buf
+}
+
+func decodeMsgpack(buf []byte) testReply {
+	var reply testReply
+	dec := msgpack.NewDecoder(bytes.NewReader(buf))
+	dec.SetCustomStructTag(`json`)
+	Expect(dec.Decode(&reply)).To(Succeed())
+	return reply
+}
+
+func DialProtocol(addr, protocol string) *ApiClient {
+	ws, err := websocket.Dial(`ws://`+addr+`/`, protocol, `http://127.0.0.1/`)
+	Expect(err).To(Succeed())
+	return &ApiClient{ws}
+}
+
+var _ = Describe("codec", func() {
+	var (
+		router *apiserver.Router
+	)
+	BeforeEach(func() {
+		router = apiserver.NewRouter()
+		router.RegisterApiHandler(0, `cmdname`, func(conn apiserver.Conn, req *testEchoRequest) (*testEchoResponce, error) {
+			return &testEchoResponce{Pong: req.Ping}, nil
+		})
+	})
+	It(`chooses codec by subprotocol`, func() {
+		_, httpserver, port := startServer(apiserver.ServerOpts{
+			Router: router,
+		})
+		defer httpserver.Shutdown(context.Background())
+		c := DialProtocol(`127.0.0.1:`+strconv.Itoa(port), `msgpack`)
+		defer c.ws.Close()
+		Expect(c.ws.Config().Protocol).To(Equal([]string{`msgpack`}))
+		c.ws.PayloadType = websocket.BinaryFrame
+		Expect(c.Send(encodeMsgpack(testPacket(7, `cmdname`, map[string]interface{}{`ping`: `packed`})))).To(Succeed())
+		var frame []byte
+		Expect(websocket.Message.Receive(c.ws, &frame)).To(Succeed())
+		Expect(decodeMsgpack(frame)).To(Equal(testReply{
+			Cid:  7,
+			Cmds: []testReplyCommand{{Name: `test_echo_responce`, Data: map[string]interface{}{`pong`: `packed`}}},
+		}))
+	})
+	It(`falls back to JSON for unknown subprotocol`, func() {
+		_, httpserver, port := startServer(apiserver.ServerOpts{
+			Router: router,
+			Codecs: []apiserver.Codec{apiserver.JSONCodec},
+		})
+		defer httpserver.Shutdown(context.Background())
+		c := DialProtocol(`127.0.0.1:`+strconv.Itoa(port), `msgpack`)
+		defer c.ws.Close()
+		Expect(c.ws.Config().Protocol).To(Equal([]string{`msgpack`}))
+		Expect(c.Send([]byte(`{ "cid": 1, "cmds":[{ "name" : "cmdname", "data" : { "ping" : "text" } }]}`))).To(Succeed())
+		Expect(c.Await()).To(MatchJSON(`{ "cid": 1, "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "text" } }]}`))
+	})
+	It(`encodes broadcast for codec of every connection`, func() {
+		broker := apiserver.NewMemoryBroker()
+		nodeA := startNode(broker)
+		defer nodeA.Stop()
+		nodeB := startNode(broker)
+		defer nodeB.Stop()
+		onA := nodeA.Connect()
+		defer onA.ws.Close()
+		onB := DialProtocol(`127.0.0.1:`+strconv.Itoa(nodeB.port), `cbor`)
+		defer onB.ws.Close()
+		Eventually(nodeB.server.Count).Should(Equal(1))
+		Expect(nodeA.server.BroadcastAll(StillAlive{Ping: `everyone`})).To(Succeed())
+		Expect(onA.Await()).To(MatchJSON(`{ "cmds": [{  "name" : "StillAlive", "data":{"ping":"everyone"} }]}`))
+		var reply testReply
+		Expect(cbor.Unmarshal(must(onB.Await()), &reply)).To(Succeed())
+		Expect(reply.Cmds).To(Equal([]testReplyCommand{{Name: `StillAlive`, Data: map[string]interface{}{`ping`: `everyone`}}}))
+	})
+	It(`decodes command data with codec of connection`, func() {
+		router.EnableStrictDecoding(0)
+		conn := apiserver.NewFakeConn()
+		conn.CodecValue = apiserver.CBORCodec
+		buf, err := cbor.Marshal(testPacket(1, `cmdname`, map[string]interface{}{`ping`: `cbor`}))
+		Expect(err).To(Succeed())
+		router.ProcessPacket(conn, buf)
+		buf, err = cbor.Marshal(testPacket(2, `cmdname`, map[string]interface{}{`ping`: `cbor`, `typo`: 1}))
+		Expect(err).To(Succeed())
+		router.ProcessPacket(conn, buf)
+
+		var reply testReply
+		Expect(cbor.Unmarshal(conn.Written[0], &reply)).To(Succeed())
+		Expect(reply.Cmds).To(Equal([]testReplyCommand{{Name: `test_echo_responce`, Data: map[string]interface{}{`pong`: `cbor`}}}))
+		Expect(cbor.Unmarshal(conn.Written[1], &reply)).To(Succeed())
+		Expect(reply.Cmds[0].Name).To(Equal(`Error`))
+		Expect(reply.Cmds[0].Data).To(HaveKeyWithValue(`type`, `unknown_field`))
+	})
+	It(`rejects unknown msgpack fields in strict mode`, func() {
+		router.EnableStrictDecoding(0)
+		conn := apiserver.NewFakeConn()
+		conn.CodecValue = apiserver.MsgpackCodec
+		router.ProcessPacket(conn, encodeMsgpack(testPacket(1, `cmdname`, map[string]interface{}{`ping`: `x`, `typo`: 1})))
+		Expect(decodeMsgpack(conn.Written[0]).Cmds).To(Equal([]testReplyCommand{{Name: `Error`, Data: map[string]interface{}{
+			`type`: `unknown_field`,
+			`msg`:  `unknown field "typo"`,
+		}}}))
+	})
+})
+
+func must(buf []byte, err error) []byte {
+	Expect(err).To(Succeed())
+	return buf
+}
@@ -0,0 +1,145 @@
+package apiserver_test
+
+import (
+	"compress/flate"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	gorilla "github.com/gorilla/websocket"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/x12tech/go-websocketapi/apiserver"
+)
+
+// countingConn counts bytes received from server to tell compressed frames apart
+type countingConn struct {
+	net.Conn
+	read *int64
+}
+
+func (self countingConn) Read(b []byte) (int, error) {
+	n, err := self.Conn.Read(b)
+	atomic.AddInt64(self.read, int64(n))
+	return n, err
+}
+
+func dialCompressed(port int, read *int64) *gorilla.Conn {
+	dialer := gorilla.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			return countingConn{Conn: conn, read: read}, err
+		},
+	}
+	ws, resp, err := dialer.Dial(`ws://127.0.0.1:`+strconv.Itoa(port)+`/`, nil)
+	Expect(err).To(Succeed())
+	Expect(resp.Header.Get(`Sec-Websocket-Extensions`)).To(ContainSubstring(`permessage-deflate`))
+	return ws
+}
+
+var _ = Describe("compression", func() {
+	var (
+		router *apiserver.Router
+		ping   string
+	)
+	BeforeEach(func() {
+		router = apiserver.NewRouter()
+		router.RegisterApiHandler(0, `cmdname`, func(conn apiserver.Conn, req *testEchoRequest) (*testEchoResponce, error) {
+			return &testEchoResponce{Pong: req.Ping}, nil
+		})
+		ping = strings.Repeat(`compressible `, 5000)
+	})
+	echo := func(ws *gorilla.Conn) {
+		Expect(ws.WriteMessage(gorilla.TextMessage, []byte(`{ "cid": 1, "cmds":[{ "name" : "cmdname", "data" : { "ping" : "`+ping+`" } }]}`))).To(Succeed())
+		_, buf, err := ws.ReadMessage()
+		Expect(err).To(Succeed())
+		Expect(buf).To(MatchJSON(`{ "cid": 1, "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "` + ping + `" } }]}`))
+	}
+	It(`compresses packets with client supporting permessage-deflate`, func() {
+		_, httpserver, port := startServer(apiserver.ServerOpts{
+			Router:            router,
+			EnableCompression: true,
+		})
+		defer httpserver.Shutdown(context.Background())
+		var read int64
+		ws := dialCompressed(port, &read)
+		defer ws.Close()
+		echo(ws)
+		Expect(atomic.LoadInt64(&read)).To(BeNumerically(`<`, len(ping)/10))
+	})
+	It(`sends packets below threshold uncompressed`, func() {
+		_, httpserver, port := startServer(apiserver.ServerOpts{
+			Router:               router,
+			EnableCompression:    true,
+			CompressionLevel:     9,
+			CompressionThreshold: 1 << 20,
+		})
+		defer httpserver.Shutdown(context.Background())
+		var read int64
+		ws := dialCompressed(port, &read)
+		defer ws.Close()
+		echo(ws)
+		Expect(atomic.LoadInt64(&read)).To(BeNumerically(`>`, len(ping)))
+	})
+	It(`serves clients without compression`, func() {
+		_, httpserver, port := startServer(apiserver.ServerOpts{
+			Router:            router,
+			EnableCompression: true,
+		})
+		defer httpserver.Shutdown(context.Background())
+		c, err := Dial(`127.0.0.1:` + strconv.Itoa(port))
+		Expect(err).To(Succeed())
+		defer c.ws.Close()
+		Expect(c.Send([]byte(`{ "cid": 1, "cmds":[{ "name" : "cmdname", "data" : { "ping" : "plain" } }]}`))).To(Succeed())
+		Expect(c.Await()).To(MatchJSON(`{ "cid": 1, "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "plain" } }]}`))
+	})
+	It(`limits decompressed message size`, func() {
+		_, httpserver, port := startServer(apiserver.ServerOpts{
+			Router:            router,
+			EnableCompression: true,
+			MaxMessageSize:    1024,
+		})
+		defer httpserver.Shutdown(context.Background())
+		var read int64
+		ws := dialCompressed(port, &read)
+		defer ws.Close()
+		Expect(ws.WriteMessage(gorilla.TextMessage, []byte(`{ "cid": 1, "cmds":[{ "name" : "cmdname", "data" : { "ping" : "`+ping+`" } }]}`))).To(Succeed())
+		_, buf, err := ws.ReadMessage()
+		Expect(err).To(Succeed())
+		Expect(buf).To(MatchJSON(`{ "cmds":[{ "name" : "Error", "data" : { "type" : "message_too_large", "msg" : "message exceeds 1024 bytes" } }]}`))
+		_, _, err = ws.ReadMessage()
+		Expect(gorilla.IsCloseError(err, apiserver.CloseMessageTooBig)).To(BeTrue())
+	})
+	It(`rejects compression with x/net upgrader`, func() {
+		_, err := apiserver.NewServer(apiserver.ServerOpts{
+			Router:            router,
+			EnableCompression: true,
+			Upgrader:          apiserver.NewXNetUpgrader(),
+		})
+		Expect(err).To(HaveOccurred())
+		_, err = apiserver.NewServer(apiserver.ServerOpts{
+			Router:            router,
+			EnableCompression: true,
+			CompressionLevel:  42,
+		})
+		Expect(err).To(HaveOccurred())
+	})
+	It(`rejects compression level with coder upgrader`, func() {
+		_, err := apiserver.NewServer(apiserver.ServerOpts{
+			Router:            router,
+			EnableCompression: true,
+			CompressionLevel:  flate.BestSpeed,
+			Upgrader:          apiserver.NewCoderUpgrader(apiserver.CoderOpts{}),
+		})
+		Expect(err).To(HaveOccurred())
+		_, err = apiserver.NewServer(apiserver.ServerOpts{
+			Router:            router,
+			EnableCompression: true,
+			Upgrader:          apiserver.NewCoderUpgrader(apiserver.CoderOpts{}),
+		})
+		Expect(err).To(Succeed())
+	})
+})
@@ -1,10 +1,80 @@
 package apiserver
 
 import (
+	"context"
 	"io"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"golang.org/x/net/websocket"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrConnectionClosed  = errors.New(`connection closed`)
+	ErrSendQueueOverflow = errors.New(`send queue overflow`)
+)
+
+// close reasons
+var (
+	ErrClosedByServer  = errors.New(`closed by server`)
+	ErrPeerClosed      = errors.New(`closed by peer`)
+	ErrMessageTooLarge = errors.New(`message too large`)
+	ErrPongTimeout     = errors.New(`pong timeout`)
+	ErrIdleTimeout     = errors.New(`idle timeout`)
+	ErrServerShutdown  = errors.New(`server shutdown`)
+)
+
+// websocket close codes
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// closeCodeOf tells peer whether connection was closed on purpose, CloseNormal is sent only when
+// either side closed it, timeouts and failures get CloseInternalError
+func closeCodeOf(reason error) int {
+	switch reason {
+	case ErrClosedByServer, ErrPeerClosed:
+		return CloseNormal
+	case ErrServerShutdown:
+		return CloseGoingAway
+	case ErrSendQueueOverflow:
+		return ClosePolicyViolation
+	case ErrMessageTooLarge:
+		return CloseMessageTooBig
+	}
+	return CloseInternalError
+}
+
+// maxCloseReason is the room left for reason in a close frame after status code
+const maxCloseReason = 123
+
+// closeReasonText is sent in close frame, truncated as control frame payload is limited
+func closeReasonText(reason error) string {
+	text := reason.Error()
+	if len(text) > maxCloseReason {
+		text = strings.ToValidUTF8(text[:maxCloseReason], ``)
+	}
+	return text
+}
+
+// OverflowPolicy defines what Connection does when its send queue is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the sender until the queue has room or the connection is closed
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest queued packet to make room
+	OverflowDropOldest
+	// OverflowDisconnect closes the connection of a slow consumer
+	OverflowDisconnect
 )
 
 type Conn interface {
@@ -12,59 +82,250 @@ type Conn interface {
 	Send(cmds ...CmdNamer) error
 	// private method for write responces
 	send([]byte) error
+	// sendPush sends push encoded once for every connection it goes to
+	sendPush(packet *encodedPacket) error
 	Session() interface{}
 	SetSession(v interface{})
+	// ID is unique among connections of a Server
+	ID() uint64
+	// Context is cancelled when connection is closed
+	Context() context.Context
+	// Version is API version negotiated with client, 0 by default
+	Version() int
+	SetVersion(v int)
 	Close()
+	// codec encodes packets sent to connection and decodes command data
+	codec() Codec
 }
 
-type onInputFunc func(Conn, []byte)
+// onInputFunc processes packet and returns reply to send, nil if there is none.
+// done is called once reply is handed to send.
+type onInputFunc func(Conn, []byte) (reply []byte, done func())
+
+type connOpts struct {
+	maxMessageSize       int
+	sendQueueSize        int
+	overflowPolicy       OverflowPolicy
+	writeTimeout         time.Duration
+	pingInterval         time.Duration
+	pongTimeout          time.Duration
+	idleTimeout          time.Duration
+	dispatchMode         DispatchMode
+	maxConcurrentPackets int
+}
 
 type Connection struct {
-	sess      interface{}
-	onInput   onInputFunc
-	onClose   func(Conn)
-	ws        *websocket.Conn
-	log       Logger
-	cmdLogger CmdLogger
+	connOpts
+	id          uint64
+	version     int64
+	sess        interface{}
+	onInput     onInputFunc
+	onClose     func(Conn)
+	transport   Transport
+	log         Logger
+	cmdLogger   CmdLogger
+	outbox      chan []byte
+	closed      chan struct{}
+	writerDone  chan struct{}
+	closeOnce   sync.Once
+	closeReason error
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wireCodec   Codec
+}
+
+func newConnection(t Transport, opts connOpts) *Connection {
+	// request context carries values of http middleware
+	ctx := context.Background()
+	if req := t.Request(); req != nil {
+		ctx = req.Context()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &Connection{
+		connOpts:   opts,
+		transport:  t,
+		outbox:     make(chan []byte, opts.sendQueueSize),
+		closed:     make(chan struct{}),
+		writerDone: make(chan struct{}),
+		ctx:        ctx,
+		cancel:     cancel,
+		wireCodec:  JSONCodec,
+	}
 }
 
 func (self *Connection) Start() {
-	buf := make([]byte, 8000)
+	go self.writeLoop()
+	dispatcher := newDispatcher(self)
+	defer dispatcher.stop()
 	for {
-		n, err := self.ws.Read(buf)
-		if err != nil && err != io.EOF {
-			self.Close()
+		if self.idleTimeout > 0 {
+			self.transport.SetReadDeadline(time.Now().Add(self.idleTimeout))
+		}
+		buf, err := self.transport.ReadMessage()
+		if err == ErrMessageTooLarge {
+			self.log.Println(`IN: message exceeds`, self.maxMessageSize, `bytes`)
+			self.send(marshallPacket(self.wireCodec, PacketOut{
+				Commands: apiErrorCommands(`message_too_large`, `message exceeds `+strconv.Itoa(self.maxMessageSize)+` bytes`),
+			}))
+			self.closeWithReason(ErrMessageTooLarge)
 			break
 		}
-		if err == io.EOF {
-			self.Close()
+		if err != nil {
+			self.closeWithReason(readErrorReason(err))
 			break
 		}
-		self.log.Println(`IN:`, string(buf[0:n]))
-		self.onInput(self, buf[0:n])
+		self.log.Println(`IN:`, string(buf))
+		dispatcher.dispatch(buf)
 	}
 }
 
-func (self *Connection) send(buf []byte) error {
-	self.log.Println(`OUT:`, string(buf))
-	_, err := self.ws.Write(buf)
-	if err != nil {
-		self.Close()
+func readErrorReason(err error) error {
+	if err == io.EOF {
+		return ErrPeerClosed
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return ErrIdleTimeout
 	}
 	return err
 }
-func (self *Connection) Send(cmds ...CmdNamer) error {
-	packet := PacketOut{
-		Commands: make([]CommandOut, 0, len(cmds)),
+
+func (self *Connection) writeLoop() {
+	defer close(self.writerDone)
+	var pingCh, pongCh <-chan time.Time
+	var pingSent time.Time
+	_, tracksReads := self.transport.LastRead()
+	if self.pingInterval > 0 {
+		pingTicker := time.NewTicker(self.pingInterval)
+		defer pingTicker.Stop()
+		pingCh = pingTicker.C
 	}
-	for _, cmd := range cmds {
-		packet.Commands = append(packet.Commands, CommandOut{Name: cmd.CmdName(), Data: cmd})
+	pongTimer := time.NewTimer(self.pongTimeout)
+	pongTimer.Stop()
+	defer pongTimer.Stop()
+	for {
+		select {
+		case buf := <-self.outbox:
+			if err := self.write(buf); err != nil {
+				go self.closeWithReason(err)
+				return
+			}
+		case <-pingCh:
+			if tracksReads && pongCh == nil {
+				pingSent = time.Now()
+				pongTimer.Reset(self.pongTimeout)
+				pongCh = pongTimer.C
+			}
+			if err := self.ping(); err != nil {
+				go self.closeWithReason(err)
+				return
+			}
+		case <-pongCh:
+			pongCh = nil
+			if lastRead, _ := self.transport.LastRead(); lastRead.Before(pingSent) {
+				self.log.Println(`no pong in`, self.pongTimeout)
+				go self.closeWithReason(ErrPongTimeout)
+				return
+			}
+		case <-self.closed:
+			// flush what was queued before close
+			for {
+				select {
+				case buf := <-self.outbox:
+					if err := self.write(buf); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
 	}
+}
+
+func (self *Connection) write(buf []byte) error {
+	self.log.Println(`OUT:`, string(buf))
+	self.setWriteDeadline()
+	return self.transport.WriteMessage(buf, self.wireCodec.Binary())
+}
+
+func (self *Connection) ping() error {
+	self.setWriteDeadline()
+	return self.transport.Ping()
+}
+
+func (self *Connection) setWriteDeadline() {
+	if self.writeTimeout > 0 {
+		self.transport.SetWriteDeadline(time.Now().Add(self.writeTimeout))
+	}
+}
+
+func (self *Connection) send(buf []byte) error {
+	select {
+	case <-self.closed:
+		return ErrConnectionClosed
+	default:
+	}
+	switch self.overflowPolicy {
+	case OverflowDropOldest:
+		for {
+			select {
+			case self.outbox <- buf:
+				return nil
+			default:
+			}
+			select {
+			case dropped := <-self.outbox:
+				self.log.Println(`DROP:`, string(dropped))
+			default:
+			}
+		}
+	case OverflowDisconnect:
+		select {
+		case self.outbox <- buf:
+			return nil
+		default:
+			self.log.Println(`send queue overflow, disconnecting`)
+			self.closeWithReason(ErrSendQueueOverflow)
+			return ErrSendQueueOverflow
+		}
+	default:
+		select {
+		case self.outbox <- buf:
+			return nil
+		case <-self.closed:
+			return ErrConnectionClosed
+		}
+	}
+}
+func (self *Connection) Send(cmds ...CmdNamer) error {
+	return self.sendPush(newEncodedPacket(pushPacket(cmds...)))
+}
+
+func (self *Connection) sendPush(packet *encodedPacket) error {
 	if self.cmdLogger != nil {
-		self.cmdLogger.LogPush(self.Session(), &packet)
+		self.cmdLogger.LogPush(self.Session(), packet.decoded())
 	}
-	buf := marshallPacket(packet)
-	return self.send(buf)
+	return self.send(packet.encode(self.wireCodec))
+}
+
+func (self *Connection) codec() Codec {
+	return self.wireCodec
+}
+
+func (self *Connection) ID() uint64 {
+	return self.id
+}
+
+func (self *Connection) Context() context.Context {
+	return self.ctx
+}
+
+func (self *Connection) Version() int {
+	return int(atomic.LoadInt64(&self.version))
+}
+
+func (self *Connection) SetVersion(v int) {
+	atomic.StoreInt64(&self.version, int64(v))
 }
 
 func (self *Connection) SetSession(v interface{}) {
@@ -79,20 +340,57 @@ type Closer interface {
 	Close()
 }
 
-func (self *Connection) Close() {
-	self.log.Println(`Close()`)
-	self.log.Println(self.sess)
-	if sessionCloser, ok := self.sess.(Closer); ok {
+// ReasonCloser may be implemented by session instead of Closer to know why connection was closed
+type ReasonCloser interface {
+	CloseWithReason(reason error)
+}
+
+func closeSession(sess interface{}, reason error) {
+	if reasonCloser, ok := sess.(ReasonCloser); ok {
+		reasonCloser.CloseWithReason(reason)
+	} else if sessionCloser, ok := sess.(Closer); ok {
 		sessionCloser.Close()
 	}
-	self.onClose(self)
-	self.ws.Close()
+}
+
+func (self *Connection) Close() {
+	self.closeWithReason(ErrClosedByServer)
+}
+
+// CloseReason returns why connection was closed, nil while it is open
+func (self *Connection) CloseReason() error {
+	select {
+	case <-self.closed:
+		return self.closeReason
+	default:
+		return nil
+	}
+}
+
+func (self *Connection) closeWithReason(reason error) {
+	self.closeOnce.Do(func() {
+		self.log.Println(`Close()`, reason)
+		self.log.Println(self.sess)
+		self.closeReason = reason
+		close(self.closed)
+		self.cancel()
+		closeSession(self.sess, reason)
+		self.onClose(self)
+		<-self.writerDone
+		self.setWriteDeadline()
+		self.transport.Close(closeCodeOf(reason), closeReasonText(reason))
+	})
 }
 
 type FakeConn struct {
+	IDValue      uint64
+	VersionValue int
+	ContextValue context.Context
 	SessionValue interface{}
-	Written      [][]byte
-	Mu           sync.Mutex
+	// CodecValue is JSONCodec if nil
+	CodecValue Codec
+	Written    [][]byte
+	Mu         sync.Mutex
 }
 
 func NewFakeConn() *FakeConn {
@@ -107,14 +405,18 @@ func (self *FakeConn) send(buf []byte) error {
 }
 
 func (self *FakeConn) Send(cmds ...CmdNamer) error {
-	packet := PacketOut{
-		Commands: make([]CommandOut, 0, len(cmds)),
-	}
-	for _, cmd := range cmds {
-		packet.Commands = append(packet.Commands, CommandOut{Name: cmd.CmdName(), Data: cmd})
+	return self.sendPush(newEncodedPacket(pushPacket(cmds...)))
+}
+
+func (self *FakeConn) sendPush(packet *encodedPacket) error {
+	return self.send(packet.encode(self.codec()))
+}
+
+func (self *FakeConn) codec() Codec {
+	if self.CodecValue == nil {
+		return JSONCodec
 	}
-	buf := marshallPacket(packet)
-	return self.send(buf)
+	return self.CodecValue
 }
 
 func (self *FakeConn) Session() interface{} {
@@ -125,5 +427,24 @@ func (self *FakeConn) SetSession(v interface{}) {
 	self.SessionValue = v
 }
 
+func (self *FakeConn) ID() uint64 {
+	return self.IDValue
+}
+
+func (self *FakeConn) Version() int {
+	return self.VersionValue
+}
+
+func (self *FakeConn) SetVersion(v int) {
+	self.VersionValue = v
+}
+
+func (self *FakeConn) Context() context.Context {
+	if self.ContextValue == nil {
+		return context.Background()
+	}
+	return self.ContextValue
+}
+
 func (*FakeConn) Close() {
 }
@@ -5,6 +5,8 @@ import "encoding/json"
 type ErrorCommand struct {
 	Type    string `json:"type"`
 	Message string `json:"msg"`
+	// Fields are set by validation_error
+	Fields []FieldError `json:"fields,omitempty"`
 }
 
 func (ErrorCommand) CmdName() string {
@@ -35,7 +37,8 @@ func apiErrorCommands(typ, message string) []CommandOut {
 }
 
 type CommandIn struct {
-	Name string          `json:"name"`
+	Name string `json:"name"`
+	// Data is left in encoding of connection codec until handler is called, it is JSON only for JSONCodec
 	Data json.RawMessage `json:"data,omitempty"`
 }
 
@@ -0,0 +1,85 @@
+package apiserver
+
+// DispatchMode defines how packets of one connection are processed
+type DispatchMode int
+
+const (
+	// DispatchSequential processes packets one by one, next packet is read after reply is queued
+	DispatchSequential DispatchMode = iota
+	// DispatchOrdered processes packets concurrently, replies are sent in order packets arrived
+	DispatchOrdered
+	// DispatchUnordered processes packets concurrently, every reply is sent as soon as it is ready,
+	// client matches them by cid
+	DispatchUnordered
+)
+
+// dispatcher runs onInput of a connection according to its DispatchMode,
+// dispatch blocks the read loop while maxConcurrentPackets are in progress
+type dispatcher struct {
+	conn    *Connection
+	workers chan struct{}
+	replies chan chan reply
+}
+
+type reply struct {
+	buf  []byte
+	done func()
+}
+
+func newDispatcher(conn *Connection) *dispatcher {
+	self := &dispatcher{
+		conn: conn,
+	}
+	if conn.dispatchMode == DispatchSequential {
+		return self
+	}
+	self.workers = make(chan struct{}, conn.maxConcurrentPackets)
+	if conn.dispatchMode == DispatchOrdered {
+		self.replies = make(chan chan reply, conn.maxConcurrentPackets)
+		go self.replyLoop()
+	}
+	return self
+}
+
+func (self *dispatcher) dispatch(buf []byte) {
+	switch self.conn.dispatchMode {
+	case DispatchOrdered:
+		self.workers <- struct{}{}
+		replyCh := make(chan reply, 1)
+		self.replies <- replyCh
+		go func() {
+			defer func() { <-self.workers }()
+			buf, done := self.conn.onInput(self.conn, buf)
+			replyCh <- reply{buf, done}
+		}()
+	case DispatchUnordered:
+		self.workers <- struct{}{}
+		go func() {
+			defer func() { <-self.workers }()
+			self.send(self.conn.onInput(self.conn, buf))
+		}()
+	default:
+		self.send(self.conn.onInput(self.conn, buf))
+	}
+}
+
+// stop is called when read loop exits, packets in progress still get their replies
+func (self *dispatcher) stop() {
+	if self.replies != nil {
+		close(self.replies)
+	}
+}
+
+func (self *dispatcher) replyLoop() {
+	for replyCh := range self.replies {
+		r := <-replyCh
+		self.send(r.buf, r.done)
+	}
+}
+
+func (self *dispatcher) send(buf []byte, done func()) {
+	defer done()
+	if buf != nil {
+		self.conn.send(buf)
+	}
+}
@@ -0,0 +1,85 @@
+package apiserver_test
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/x12tech/go-websocketapi/apiserver"
+)
+
+var _ = Describe("dispatch", func() {
+	var (
+		router     *apiserver.Router
+		httpserver *http.Server
+		port       int
+		release    chan struct{}
+		fastDone   chan struct{}
+	)
+	BeforeEach(func() {
+		release = make(chan struct{})
+		fastDone = make(chan struct{}, 1)
+		router = apiserver.NewRouter()
+		router.RegisterApiHandler(0, `slow`, func(conn apiserver.Conn) (*testEchoResponce, error) {
+			<-release
+			return &testEchoResponce{Pong: `slow`}, nil
+		})
+		router.RegisterApiHandler(0, `fast`, func(conn apiserver.Conn) (*testEchoResponce, error) {
+			fastDone <- struct{}{}
+			return &testEchoResponce{Pong: `fast`}, nil
+		})
+	})
+	AfterEach(func() {
+		httpserver.Shutdown(context.Background())
+	})
+	var Start = func(mode apiserver.DispatchMode, limit int) *ApiClient {
+		_, httpserver, port = startServer(apiserver.ServerOpts{
+			Router:               router,
+			DispatchMode:         mode,
+			MaxConcurrentPackets: limit,
+		})
+		c, err := Dial(`127.0.0.1:` + strconv.Itoa(port))
+		Expect(err).To(Succeed())
+		Expect(c.Send([]byte(`{ "cid": 1, "cmds":[{ "name" : "slow" }]}`))).To(Succeed())
+		Expect(c.Send([]byte(`{ "cid": 2, "cmds":[{ "name" : "fast" }]}`))).To(Succeed())
+		return c
+	}
+	const (
+		slowReply = `{ "cid": 1, "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "slow" } }]}`
+		fastReply = `{ "cid": 2, "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "fast" } }]}`
+	)
+	It(`processes packets one by one by default`, func() {
+		c := Start(apiserver.DispatchSequential, 0)
+		defer c.ws.Close()
+		Consistently(fastDone, 50*time.Millisecond).ShouldNot(Receive())
+		close(release)
+		Expect(c.Await()).To(MatchJSON(slowReply))
+		Expect(c.Await()).To(MatchJSON(fastReply))
+	})
+	It(`sends replies as soon as they are ready in unordered mode`, func() {
+		c := Start(apiserver.DispatchUnordered, 0)
+		defer c.ws.Close()
+		Expect(c.Await()).To(MatchJSON(fastReply))
+		close(release)
+		Expect(c.Await()).To(MatchJSON(slowReply))
+	})
+	It(`keeps order of replies in ordered mode`, func() {
+		c := Start(apiserver.DispatchOrdered, 0)
+		defer c.ws.Close()
+		Eventually(fastDone).Should(Receive())
+		close(release)
+		Expect(c.Await()).To(MatchJSON(slowReply))
+		Expect(c.Await()).To(MatchJSON(fastReply))
+	})
+	It(`limits packets processed at once`, func() {
+		c := Start(apiserver.DispatchUnordered, 1)
+		defer c.ws.Close()
+		Consistently(fastDone, 50*time.Millisecond).ShouldNot(Receive())
+		close(release)
+		Expect(c.Await()).To(MatchJSON(slowReply))
+		Expect(c.Await()).To(MatchJSON(fastReply))
+	})
+})
@@ -0,0 +1,366 @@
+package apiserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fallback transport serves clients whose proxies break websocket upgrade. Connection is opened by
+//   GET with Accept: text/event-stream, packets arrive as SSE data events, the first event is
+//   "open" with {"token": ...}, the last one is "close" with {"code": ..., "reason": ...};
+//   or POST ?transport=poll answered with {"token": ...}, then packets are fetched by GET ?token=
+//   as JSON array, empty if none arrive within poll timeout, 410 Gone when connection is closed.
+// Packets are sent by POST ?token= with packet in body, DELETE ?token= closes connection.
+// SSE stream may be reopened with ?token= as EventSource does. Packets are JSON encoded,
+// one taken by a poll request which fails to deliver it is lost.
+
+const (
+	DefaultPollTimeout              = 25 * time.Second
+	DefaultFallbackReconnectTimeout = 30 * time.Second
+)
+
+type fallbackTransport struct {
+	req *http.Request
+	in  chan fallbackInbound
+	out chan []byte
+	// pings ask SSE stream to write a comment, so proxies see the stream alive
+	pings            chan struct{}
+	done             chan struct{}
+	closeOnce        sync.Once
+	closeCode        int
+	closeReason      string
+	reconnectTimeout time.Duration
+	mu               sync.Mutex
+	downstreams      int
+	abandon          *time.Timer
+	readDeadline     time.Time
+	writeDeadline    time.Time
+}
+
+type fallbackInbound struct {
+	buf      []byte
+	tooLarge bool
+}
+
+func newFallbackTransport(req *http.Request, reconnectTimeout time.Duration) *fallbackTransport {
+	self := &fallbackTransport{
+		// connection outlives request which opened it, but keeps values of http middleware
+		req:              req.WithContext(context.WithoutCancel(req.Context())),
+		in:               make(chan fallbackInbound),
+		out:              make(chan []byte),
+		pings:            make(chan struct{}, 1),
+		done:             make(chan struct{}),
+		reconnectTimeout: reconnectTimeout,
+	}
+	self.abandon = time.AfterFunc(reconnectTimeout, func() {
+		self.Close(CloseNormal, ErrPeerClosed.Error())
+	})
+	return self
+}
+
+// attach marks client waiting for packets, connection is closed if none waits for reconnect timeout
+func (self *fallbackTransport) attach() (detach func()) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.downstreams++
+	self.abandon.Stop()
+	return func() {
+		self.mu.Lock()
+		defer self.mu.Unlock()
+		self.downstreams--
+		if self.downstreams == 0 {
+			self.abandon.Reset(self.reconnectTimeout)
+		}
+	}
+}
+
+func (self *fallbackTransport) Request() *http.Request {
+	return self.req
+}
+
+func (self *fallbackTransport) Subprotocol() string {
+	return ``
+}
+
+func deadlineTimer(deadline time.Time) (<-chan time.Time, func() bool) {
+	if deadline.IsZero() {
+		return nil, func() bool { return false }
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	return timer.C, timer.Stop
+}
+
+func (self *fallbackTransport) ReadMessage() ([]byte, error) {
+	expired, stop := deadlineTimer(self.readDeadline)
+	defer stop()
+	select {
+	case msg := <-self.in:
+		if msg.tooLarge {
+			return nil, ErrMessageTooLarge
+		}
+		return msg.buf, nil
+	case <-self.done:
+		return nil, io.EOF
+	case <-expired:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+// post hands packet of client to ReadMessage
+func (self *fallbackTransport) post(msg fallbackInbound) error {
+	select {
+	case self.in <- msg:
+		return nil
+	case <-self.done:
+		return ErrConnectionClosed
+	}
+}
+
+// WriteMessage waits for SSE stream or poll request to take buf
+func (self *fallbackTransport) WriteMessage(buf []byte, binary bool) error {
+	expired, stop := deadlineTimer(self.writeDeadline)
+	defer stop()
+	select {
+	case self.out <- buf:
+		return nil
+	case <-self.done:
+		return ErrConnectionClosed
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (self *fallbackTransport) Ping() error {
+	select {
+	case self.pings <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// LastRead is unknown, as client has no way to answer pings
+func (self *fallbackTransport) LastRead() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (self *fallbackTransport) SetReadDeadline(t time.Time) error {
+	self.readDeadline = t
+	return nil
+}
+
+func (self *fallbackTransport) SetWriteDeadline(t time.Time) error {
+	self.writeDeadline = t
+	return nil
+}
+
+func (self *fallbackTransport) Close(code int, reason string) error {
+	self.closeOnce.Do(func() {
+		self.closeCode = code
+		self.closeReason = reason
+		self.abandon.Stop()
+		close(self.done)
+	})
+	return nil
+}
+
+func (self *fallbackTransport) closeEvent() []byte {
+	buf, _ := json.Marshal(map[string]interface{}{
+		`code`:   self.closeCode,
+		`reason`: self.closeReason,
+	})
+	return buf
+}
+
+// fallbacks keeps open fallback connections by token
+type fallbacks struct {
+	mu     sync.Mutex
+	tokens map[string]*fallbackTransport
+}
+
+func newFallbacks() *fallbacks {
+	return &fallbacks{
+		tokens: make(map[string]*fallbackTransport),
+	}
+}
+
+func (self *fallbacks) add(token string, t *fallbackTransport) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.tokens[token] = t
+}
+
+func (self *fallbacks) remove(token string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.tokens, token)
+}
+
+func (self *fallbacks) get(token string) (*fallbackTransport, bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	t, ok := self.tokens[token]
+	return t, ok
+}
+
+func isWebsocketUpgrade(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get(`Upgrade`), `websocket`)
+}
+
+func (self *Server) serveFallback(w http.ResponseWriter, req *http.Request) {
+	token := req.URL.Query().Get(`token`)
+	sse := strings.Contains(req.Header.Get(`Accept`), `text/event-stream`)
+	if token == `` {
+		switch {
+		case req.Method == http.MethodGet && sse:
+			token, t := self.openFallback(req)
+			self.streamEvents(w, req, t, token)
+		case req.Method == http.MethodPost && req.URL.Query().Get(`transport`) == `poll`:
+			token, _ := self.openFallback(req)
+			w.Header().Set(`Content-Type`, `application/json`)
+			json.NewEncoder(w).Encode(map[string]string{`token`: token})
+		default:
+			http.Error(w, `websocket upgrade or fallback transport expected`, http.StatusBadRequest)
+		}
+		return
+	}
+	t, ok := self.fallbacks.get(token)
+	if !ok {
+		http.Error(w, `unknown token`, http.StatusNotFound)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		if sse {
+			self.streamEvents(w, req, t, ``)
+		} else {
+			self.poll(w, req, t)
+		}
+	case http.MethodPost:
+		self.postPacket(w, req, t)
+	case http.MethodDelete:
+		t.Close(CloseNormal, ErrPeerClosed.Error())
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, `method not allowed`, http.StatusMethodNotAllowed)
+	}
+}
+
+func (self *Server) openFallback(req *http.Request) (string, *fallbackTransport) {
+	token := newSessionToken()
+	t := newFallbackTransport(req, self.abandonTimeout)
+	self.fallbacks.add(token, t)
+	go func() {
+		defer self.fallbacks.remove(token)
+		self.serveTransport(t)
+	}()
+	return token, t
+}
+
+// streamEvents sends packets as SSE until connection or request is done, open event is sent if token is set
+func (self *Server) streamEvents(w http.ResponseWriter, req *http.Request, t *fallbackTransport, token string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, `streaming is not supported`, http.StatusInternalServerError)
+		return
+	}
+	detach := t.attach()
+	defer detach()
+	w.Header().Set(`Content-Type`, `text/event-stream`)
+	w.Header().Set(`Cache-Control`, `no-cache`)
+	w.WriteHeader(http.StatusOK)
+	if token != `` {
+		buf, _ := json.Marshal(map[string]string{`token`: token})
+		writeEvent(w, `open`, buf)
+	}
+	flusher.Flush()
+	for {
+		select {
+		case buf := <-t.out:
+			writeEvent(w, ``, buf)
+		case <-t.pings:
+			io.WriteString(w, ": ping\n\n")
+		case <-t.done:
+			writeEvent(w, `close`, t.closeEvent())
+			flusher.Flush()
+			return
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w io.Writer, event string, data []byte) {
+	var buf bytes.Buffer
+	if event != `` {
+		buf.WriteString(`event: ` + event + "\n")
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.WriteString(`data: `)
+		buf.Write(line)
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+	w.Write(buf.Bytes())
+}
+
+// poll answers with JSON array of packets sent within poll timeout
+func (self *Server) poll(w http.ResponseWriter, req *http.Request, t *fallbackTransport) {
+	detach := t.attach()
+	defer detach()
+	timer := time.NewTimer(self.pollTimeout)
+	defer timer.Stop()
+	var packets [][]byte
+	select {
+	case buf := <-t.out:
+		packets = append(packets, buf)
+	case <-t.done:
+		w.Header().Set(`Content-Type`, `application/json`)
+		w.WriteHeader(http.StatusGone)
+		w.Write(t.closeEvent())
+		return
+	case <-timer.C:
+	case <-req.Context().Done():
+		return
+	}
+	// take what is sent at once with the first packet
+	for more := len(packets) > 0; more; {
+		select {
+		case buf := <-t.out:
+			packets = append(packets, buf)
+		default:
+			more = false
+		}
+	}
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.Write(append(append([]byte(`[`), bytes.Join(packets, []byte(`,`))...), ']'))
+}
+
+func (self *Server) postPacket(w http.ResponseWriter, req *http.Request, t *fallbackTransport) {
+	maxSize := self.connOpts.maxMessageSize
+	buf, err := io.ReadAll(io.LimitReader(req.Body, int64(maxSize)+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msg := fallbackInbound{buf: buf}
+	status := http.StatusAccepted
+	if len(buf) > maxSize {
+		msg = fallbackInbound{tooLarge: true}
+		status = http.StatusRequestEntityTooLarge
+	}
+	if err := t.post(msg); err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	w.Header().Set(`Content-Length`, strconv.Itoa(0))
+	w.WriteHeader(status)
+}
@@ -0,0 +1,176 @@
+package apiserver_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/x12tech/go-websocketapi/apiserver"
+)
+
+type sseEvent struct {
+	Event string
+	Data  string
+}
+
+func readEvent(r *bufio.Reader) sseEvent {
+	var event sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		Expect(err).To(Succeed())
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == `` && (event.Event != `` || event.Data != ``):
+			return event
+		case strings.HasPrefix(line, `event: `):
+			event.Event = strings.TrimPrefix(line, `event: `)
+		case strings.HasPrefix(line, `data: `):
+			event.Data += strings.TrimPrefix(line, `data: `)
+		}
+	}
+}
+
+func readBody(resp *http.Response, err error) (int, string) {
+	Expect(err).To(Succeed())
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	Expect(err).To(Succeed())
+	return resp.StatusCode, string(body)
+}
+
+var _ = Describe("fallback", func() {
+	var (
+		router     *apiserver.Router
+		httpserver *http.Server
+		addr       string
+		url        string
+		reasons    chan error
+	)
+	BeforeEach(func() {
+		reasons = make(chan error, 1)
+		router = apiserver.NewRouter()
+		router.RegisterApiHandler(0, `cmdname`, func(conn apiserver.Conn, req *testEchoRequest) (*testEchoResponce, error) {
+			conn.Send(StillAlive{Ping: `pushed`})
+			return &testEchoResponce{Pong: req.Ping}, nil
+		})
+		router.RegisterApiHandler(0, `bye`, func(conn apiserver.Conn, req *testEchoRequest) error {
+			go conn.Close()
+			return nil
+		})
+	})
+	AfterEach(func() {
+		httpserver.Shutdown(context.Background())
+	})
+	start := func(opts apiserver.ServerOpts) {
+		opts.Router = router
+		opts.EnableFallback = true
+		opts.NewSessionFn = func() interface{} {
+			return &reasonSession{reasons: reasons}
+		}
+		var port int
+		_, httpserver, port = startServer(opts)
+		addr = `127.0.0.1:` + strconv.Itoa(port)
+		url = `http://` + addr + `/`
+	}
+	post := func(token, body string) int {
+		status, _ := readBody(http.Post(url+`?token=`+token, `application/json`, strings.NewReader(body)))
+		return status
+	}
+	openSSE := func() (*http.Response, *bufio.Reader, string) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		Expect(err).To(Succeed())
+		req.Header.Set(`Accept`, `text/event-stream`)
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(Succeed())
+		Expect(resp.Header.Get(`Content-Type`)).To(Equal(`text/event-stream`))
+		events := bufio.NewReader(resp.Body)
+		open := readEvent(events)
+		Expect(open.Event).To(Equal(`open`))
+		var opened struct{ Token string }
+		Expect(json.Unmarshal([]byte(open.Data), &opened)).To(Succeed())
+		return resp, events, opened.Token
+	}
+	openPoll := func() string {
+		status, body := readBody(http.Post(url+`?transport=poll`, `application/json`, nil))
+		Expect(status).To(Equal(http.StatusOK))
+		var opened struct{ Token string }
+		Expect(json.Unmarshal([]byte(body), &opened)).To(Succeed())
+		return opened.Token
+	}
+	It(`pushes over SSE and takes commands by POST`, func() {
+		start(apiserver.ServerOpts{})
+		resp, events, token := openSSE()
+		defer resp.Body.Close()
+		Expect(post(token, `{ "cid": 1, "cmds":[{ "name" : "cmdname", "data" : { "ping" : "sse" } }]}`)).To(Equal(http.StatusAccepted))
+		Expect(readEvent(events).Data).To(MatchJSON(`{ "cmds": [{  "name" : "StillAlive", "data":{"ping":"pushed"} }]}`))
+		Expect(readEvent(events).Data).To(MatchJSON(`{ "cid": 1, "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "sse" } }]}`))
+
+		req, err := http.NewRequest(http.MethodDelete, url+`?token=`+token, nil)
+		Expect(err).To(Succeed())
+		status, _ := readBody(http.DefaultClient.Do(req))
+		Expect(status).To(Equal(http.StatusNoContent))
+		Eventually(reasons).Should(Receive(Equal(apiserver.ErrPeerClosed)))
+		Expect(post(token, `{ "cmds":[] }`)).To(Equal(http.StatusNotFound))
+	})
+	It(`sends close event when server closes connection`, func() {
+		start(apiserver.ServerOpts{})
+		resp, events, token := openSSE()
+		defer resp.Body.Close()
+		Expect(post(token, `{ "cmds":[{ "name" : "bye", "data" : {} }]}`)).To(Equal(http.StatusAccepted))
+		readEvent(events) // empty reply
+		closed := readEvent(events)
+		Expect(closed.Event).To(Equal(`close`))
+		Expect(closed.Data).To(MatchJSON(`{ "code": 1000, "reason": "closed by server" }`))
+		Eventually(reasons).Should(Receive(Equal(apiserver.ErrClosedByServer)))
+	})
+	It(`answers polls with packets sent meanwhile`, func() {
+		start(apiserver.ServerOpts{PollTimeout: 50 * time.Millisecond})
+		token := openPoll()
+		status, body := readBody(http.Get(url + `?token=` + token))
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(MatchJSON(`[]`))
+
+		Expect(post(token, `{ "cid": 1, "cmds":[{ "name" : "cmdname", "data" : { "ping" : "poll" } }]}`)).To(Equal(http.StatusAccepted))
+		var packets []json.RawMessage
+		Eventually(func() []json.RawMessage {
+			_, body := readBody(http.Get(url + `?token=` + token))
+			var got []json.RawMessage
+			Expect(json.Unmarshal([]byte(body), &got)).To(Succeed())
+			packets = append(packets, got...)
+			return packets
+		}).Should(HaveLen(2))
+		Expect(packets[0]).To(MatchJSON(`{ "cmds": [{  "name" : "StillAlive", "data":{"ping":"pushed"} }]}`))
+		Expect(packets[1]).To(MatchJSON(`{ "cid": 1, "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "poll" } }]}`))
+	})
+	It(`closes connection abandoned by client`, func() {
+		start(apiserver.ServerOpts{FallbackReconnectTimeout: 50 * time.Millisecond})
+		token := openPoll()
+		Eventually(reasons).Should(Receive(Equal(apiserver.ErrPeerClosed)))
+		status, _ := readBody(http.Get(url + `?token=` + token))
+		Expect(status).To(Equal(http.StatusNotFound))
+	})
+	It(`answers too large packet and closes`, func() {
+		start(apiserver.ServerOpts{MaxMessageSize: 16})
+		resp, events, token := openSSE()
+		defer resp.Body.Close()
+		Expect(post(token, `{ "cmds":[{ "name" : "cmdname", "data" : { "ping" : "sse" } }]}`)).To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(readEvent(events).Data).To(MatchJSON(`{ "cmds":[{ "name" : "Error", "data" : { "type" : "message_too_large", "msg" : "message exceeds 16 bytes" } }]}`))
+		Expect(readEvent(events).Data).To(MatchJSON(`{ "code": 1009, "reason": "message too large" }`))
+		Eventually(reasons).Should(Receive(Equal(apiserver.ErrMessageTooLarge)))
+	})
+	It(`still upgrades websocket`, func() {
+		start(apiserver.ServerOpts{})
+		c, err := Dial(addr)
+		Expect(err).To(Succeed())
+		defer c.ws.Close()
+		Expect(c.Send([]byte(`{ "cid": 1, "cmds":[{ "name" : "cmdname", "data" : { "ping" : "ws" } }]}`))).To(Succeed())
+		Expect(c.Await()).To(MatchJSON(`{ "cmds": [{  "name" : "StillAlive", "data":{"ping":"pushed"} }]}`))
+	})
+})
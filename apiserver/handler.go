@@ -1,8 +1,9 @@
 package apiserver
 
 import (
-	"encoding/json"
+	"context"
 	"reflect"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -10,11 +11,17 @@ import (
 type handlerFunc interface{}
 
 type handler struct {
-	Func       reflect.Value
-	Input      reflect.Type
-	InputPtr   bool
-	Output     []handlerOut
-	Middleware []MiddlewareFunc
+	Func        reflect.Value
+	WithContext bool
+	Input       reflect.Type
+	InputPtr    bool
+	Output      []handlerOut
+	Middleware  []ContextMiddlewareFunc
+	// Timeout overrides router command timeout if not zero
+	Timeout   time.Duration
+	validator *structValidator
+	// typedCall replaces reflective Func call for handlers registered with Handle
+	typedCall func(ctx context.Context, conn Conn, data []byte) ([]CmdNamer, error)
 }
 
 type handlerOut struct {
@@ -25,27 +32,38 @@ type handlerOut struct {
 
 var connectionType = reflect.TypeOf((*Conn)(nil)).Elem()
 var namerType = reflect.TypeOf((*CmdNamer)(nil)).Elem()
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
 
 func NewHandler(f handlerFunc, middleware []MiddlewareFunc) *handler {
+	return newHandler(f, contextMiddlewares(middleware))
+}
+
+func newHandler(f handlerFunc, middleware []ContextMiddlewareFunc) *handler {
 	funcValue := reflect.ValueOf(f)
 	funcType := funcValue.Type()
 	if funcType.Kind() != reflect.Func {
 		panic(`argument must be function`)
 	}
-	if funcType.NumIn() != 1 && funcType.NumIn() != 2 {
-		panic(funcType.String() + `must be 1 or 2 arguments`)
+	h := new(handler)
+	h.Func = funcValue
+	h.Middleware = middleware
+	connArg := 0
+	if funcType.NumIn() > 0 && funcType.In(0) == contextType {
+		h.WithContext = true
+		connArg = 1
+	}
+	if funcType.NumIn()-connArg != 1 && funcType.NumIn()-connArg != 2 {
+		panic(funcType.String() + `must be 1 or 2 arguments besides context`)
 	}
-	if !funcType.In(0).Implements(connectionType) {
+	if !funcType.In(connArg).Implements(connectionType) {
 		panic(`first argument must be Conn`)
 	}
 	if funcType.NumOut() < 1 {
 		panic(`must return 1 output or more `)
 	}
-	h := new(handler)
-	h.Func = funcValue
-	h.Middleware = middleware
-	if funcType.NumIn() == 2 {
-		h.Input, h.InputPtr = ptrType(funcType.In(1))
+	if funcType.NumIn()-connArg == 2 {
+		h.Input, h.InputPtr = ptrType(funcType.In(connArg + 1))
+		h.validator = newValidator(h.Input)
 	}
 	for i := 0; i < funcType.NumOut()-1; i++ {
 		var isSlice bool = false
@@ -70,35 +88,52 @@ func NewHandler(f handlerFunc, middleware []MiddlewareFunc) *handler {
 }
 
 func (self *handler) Call(conn Conn, data []byte) ([]CmdNamer, error) {
+	if conn == nil {
+		return nil, errors.New(`call with nil Conn`)
+	}
+	return self.CallContext(conn.Context(), conn, data)
+}
+
+func (self *handler) CallContext(ctx context.Context, conn Conn, data []byte) ([]CmdNamer, error) {
 	if conn == nil {
 		return nil, errors.New(`call with nil Conn`)
 	}
 	out := make([]CmdNamer, 0, 10)
 	for _, mw := range self.Middleware {
-		res, cont := mw(conn)
+		newCtx, res, cont := mw(ctx, conn)
+		if newCtx != nil {
+			ctx = newCtx
+		}
 		out = append(out, res...)
 		if !cont {
 			return out, nil
 		}
 	}
+	if self.typedCall != nil {
+		cmds, err := self.typedCall(ctx, conn, data)
+		return append(out, cmds...), err
+	}
 	var inputValue reflect.Value
 	if self.Input != nil {
 		inputValue = reflect.New(self.Input)
 		input := inputValue.Interface()
-		err := json.Unmarshal(data, input)
+		err := self.decode(ctx, conn, data, input)
 		if err != nil {
-			return nil, err
+			return decodeFailed(err)
 		}
 		if !self.InputPtr {
 			inputValue = inputValue.Elem()
 		}
 	}
-	var output []reflect.Value
+	args := make([]reflect.Value, 0, 3)
+	if self.WithContext {
+		args = append(args, reflect.ValueOf(&ctx).Elem())
+	}
+	args = append(args, reflect.ValueOf(conn))
 	if self.Input != nil {
-		output = self.Func.Call([]reflect.Value{reflect.ValueOf(conn), inputValue})
-	} else {
-		output = self.Func.Call([]reflect.Value{reflect.ValueOf(conn)})
+		args = append(args, inputValue)
 	}
+	output := self.Func.Call(args)
 	for i := 0; i < len(self.Output); i++ {
 		if self.Output[i].isSlice {
 			l := output[i].Len()
@@ -112,17 +147,50 @@ func (self *handler) Call(conn Conn, data []byte) ([]CmdNamer, error) {
 	var retError error
 	var outErrorValue = output[len(self.Output)]
 	if !outErrorValue.IsNil() {
-		retErrorIface := outErrorValue.Interface()
-		if errCmd, ok := retErrorIface.(CmdNamer); ok {
+		var errCmd CmdNamer
+		errCmd, retError = splitError(outErrorValue.Interface().(error))
+		if errCmd != nil {
 			out = append(out, errCmd)
-		} else {
-			retError = retErrorIface.(error)
 		}
 	}
 
 	return out, retError
 }
 
+func (self *handler) decode(ctx context.Context, conn Conn, data []byte, input interface{}) error {
+	var err error
+	if isStrictDecoding(ctx) {
+		err = conn.codec().DecodeDataStrict(data, input)
+	} else {
+		err = conn.codec().DecodeData(data, input)
+	}
+	if err != nil {
+		return err
+	}
+	if self.validator != nil {
+		if errCmd := self.validator.Validate(input); errCmd != nil {
+			return errCmd
+		}
+	}
+	return nil
+}
+
+// decodeFailed replies validation and strict decoding errors to client as is, other errors become exec_error
+func decodeFailed(err error) ([]CmdNamer, error) {
+	if errCmd, _ := splitError(err); errCmd != nil {
+		return []CmdNamer{errCmd}, nil
+	}
+	return nil, err
+}
+
+// splitError separates errors which are sent to client as commands, like ErrorCommand
+func splitError(err error) (CmdNamer, error) {
+	if errCmd, ok := err.(CmdNamer); ok {
+		return errCmd, nil
+	}
+	return nil, err
+}
+
 func getCmdNamer(value reflect.Value) CmdNamer {
 	if value.Kind() == reflect.Ptr {
 		if value.IsNil() {
@@ -1,6 +1,8 @@
 package apiserver_test
 
 import (
+	"context"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/pkg/errors"
@@ -109,4 +111,31 @@ var _ = Describe("main", func() {
 		Expect(len(cmds)).To(Equal(1))
 		Expect(cmds[0]).To(Equal(&apiserver.ErrorCommand{Type: `errtype`, Message: `descr`}))
 	})
+	It(`passes context`, func() {
+		type ctxKey struct{}
+		f := func(ctx context.Context, conn apiserver.Conn, arg *testIn) (*testOut, error) {
+			return &testOut{
+				Name: arg.Name + ctx.Value(ctxKey{}).(string),
+			}, nil
+		}
+		h := apiserver.NewHandler(f, nil)
+		Expect(h).ToNot(BeNil())
+		ctx := context.WithValue(context.Background(), ctxKey{}, ` from ctx`)
+		cmds, err := h.CallContext(ctx, apiserver.NewFakeConn(), []byte(`{ "Name": "some" }`))
+		Expect(err).To(Succeed())
+		Expect(cmds).To(Equal([]apiserver.CmdNamer{&testOut{Name: `some from ctx`}}))
+	})
+	It(`passes context without input`, func() {
+		f := func(ctx context.Context, conn apiserver.Conn) (*testOut, error) {
+			return &testOut{Name: ctx.Err().Error()}, nil
+		}
+		h := apiserver.NewHandler(f, nil)
+		conn := apiserver.NewFakeConn()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		conn.ContextValue = ctx
+		cmds, err := h.Call(conn, nil)
+		Expect(err).To(Succeed())
+		Expect(cmds).To(Equal([]apiserver.CmdNamer{&testOut{Name: `context canceled`}}))
+	})
 })
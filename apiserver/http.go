@@ -0,0 +1,440 @@
+package apiserver
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+)
+
+// SessionTokenHeader carries token of session resumed by HTTPHandler, it is set on response
+// to the token of the session request was served with
+const SessionTokenHeader = `X-Session-Token`
+
+var (
+	ErrPushNotSupported = errors.New(`push is not supported over http`)
+	// ErrRequestDone is close reason of session living for a single http request
+	ErrRequestDone = errors.New(`request done`)
+	// ErrSessionExpired is close reason of session MemorySessionStore dropped as idle or least recently used
+	ErrSessionExpired = errors.New(`session expired`)
+)
+
+// PushPolicy defines what HTTPHandler does with commands sent to connection while request runs
+type PushPolicy int
+
+const (
+	// PushReject fails Send with ErrPushNotSupported
+	PushReject PushPolicy = iota
+	// PushBuffer appends pushed commands to the reply
+	PushBuffer
+)
+
+// StoredSession is what SessionStore keeps between requests
+type StoredSession struct {
+	Session interface{}
+	Version int
+}
+
+// SessionStore keeps sessions of HTTPHandler by token
+type SessionStore interface {
+	Load(token string) (*StoredSession, bool)
+	Store(token string, s *StoredSession)
+	Delete(token string)
+}
+
+const (
+	DefaultSessionIdleTimeout = 30 * time.Minute
+	DefaultMaxSessions        = 100000
+)
+
+// MemorySessionStoreOpts limit sessions kept by MemorySessionStore
+type MemorySessionStoreOpts struct {
+	// IdleTimeout expires session not used for that long, DefaultSessionIdleTimeout if zero
+	IdleTimeout time.Duration
+	// MaxSessions evicts the least recently used session when exceeded, DefaultMaxSessions if zero
+	MaxSessions int
+}
+
+// MemorySessionStore keeps sessions in process memory. Expired and evicted sessions are closed
+// with ErrSessionExpired.
+type MemorySessionStore struct {
+	opts MemorySessionStoreOpts
+	mu   sync.Mutex
+	// lru holds *memorySession from the least recently used one
+	lru      *list.List
+	sessions map[string]*list.Element
+}
+
+type memorySession struct {
+	token    string
+	stored   *StoredSession
+	lastUsed time.Time
+}
+
+func NewMemorySessionStore(opts MemorySessionStoreOpts) *MemorySessionStore {
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = DefaultSessionIdleTimeout
+	}
+	if opts.MaxSessions <= 0 {
+		opts.MaxSessions = DefaultMaxSessions
+	}
+	return &MemorySessionStore{
+		opts:     opts,
+		lru:      list.New(),
+		sessions: make(map[string]*list.Element),
+	}
+}
+
+func (self *MemorySessionStore) Load(token string) (*StoredSession, bool) {
+	self.mu.Lock()
+	expired := self.expire(time.Now())
+	elem, ok := self.sessions[token]
+	var stored *StoredSession
+	if ok {
+		self.touch(elem)
+		stored = elem.Value.(*memorySession).stored
+	}
+	self.mu.Unlock()
+	closeExpired(expired)
+	return stored, ok
+}
+
+func (self *MemorySessionStore) Store(token string, s *StoredSession) {
+	self.mu.Lock()
+	if elem, ok := self.sessions[token]; ok {
+		elem.Value.(*memorySession).stored = s
+		self.touch(elem)
+	} else {
+		self.sessions[token] = self.lru.PushBack(&memorySession{token: token, stored: s, lastUsed: time.Now()})
+	}
+	expired := self.expire(time.Now())
+	self.mu.Unlock()
+	closeExpired(expired)
+}
+
+func (self *MemorySessionStore) Delete(token string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if elem, ok := self.sessions[token]; ok {
+		self.remove(elem)
+	}
+}
+
+func (self *MemorySessionStore) touch(elem *list.Element) {
+	elem.Value.(*memorySession).lastUsed = time.Now()
+	self.lru.MoveToBack(elem)
+}
+
+func (self *MemorySessionStore) remove(elem *list.Element) *StoredSession {
+	s := self.lru.Remove(elem).(*memorySession)
+	delete(self.sessions, s.token)
+	return s.stored
+}
+
+// expire removes idle sessions and the least recently used ones beyond MaxSessions,
+// they are closed by caller once mu is released
+func (self *MemorySessionStore) expire(now time.Time) []*StoredSession {
+	var expired []*StoredSession
+	for elem := self.lru.Front(); elem != nil; elem = self.lru.Front() {
+		if self.lru.Len() <= self.opts.MaxSessions && now.Sub(elem.Value.(*memorySession).lastUsed) < self.opts.IdleTimeout {
+			break
+		}
+		expired = append(expired, self.remove(elem))
+	}
+	return expired
+}
+
+func closeExpired(expired []*StoredSession) {
+	for _, s := range expired {
+		closeSession(s.Session, ErrSessionExpired)
+	}
+}
+
+// tokenLocks serializes requests resuming the same session, so handlers never share it concurrently
+type tokenLocks struct {
+	mu    sync.Mutex
+	locks map[string]*tokenLock
+}
+
+type tokenLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func (self *tokenLocks) lock(token string) (unlock func()) {
+	self.mu.Lock()
+	if self.locks == nil {
+		self.locks = make(map[string]*tokenLock)
+	}
+	l := self.locks[token]
+	if l == nil {
+		l = &tokenLock{}
+		self.locks[token] = l
+	}
+	l.refs++
+	self.mu.Unlock()
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		self.mu.Lock()
+		defer self.mu.Unlock()
+		l.refs--
+		if l.refs == 0 {
+			delete(self.locks, token)
+		}
+	}
+}
+
+type HTTPHandlerOpts struct {
+	Router       *Router
+	NewSessionFn func() interface{}
+	Logger       Logger
+	// MaxMessageSize limits request body size in bytes, websocket.DefaultMaxPayloadBytes if zero
+	MaxMessageSize int
+	// PushPolicy is PushReject by default
+	PushPolicy PushPolicy
+	// PubSub subscriptions made while request runs are dropped when it ends
+	PubSub *PubSub
+	// Sessions resumes session by SessionTokenHeader, every request gets a new session if nil.
+	// Unknown token starts a new session with a new token. Requests with the same token are served one by one.
+	Sessions SessionStore
+}
+
+// HTTPHandler serves JSON PacketIn POSTed in request body with PacketOut in response,
+// for clients which cannot hold a websocket open
+type HTTPHandler struct {
+	HTTPHandlerOpts
+	lastID uint64
+	tokens tokenLocks
+}
+
+func NewHTTPHandler(opts HTTPHandlerOpts) (*HTTPHandler, error) {
+	if opts.Router == nil {
+		return nil, errors.New(`router not defined`)
+	}
+	if opts.NewSessionFn == nil {
+		opts.NewSessionFn = func() interface{} {
+			return nil
+		}
+	}
+	if opts.Logger == nil {
+		opts.Logger = &EmptyLogger{}
+	}
+	if opts.MaxMessageSize <= 0 {
+		opts.MaxMessageSize = websocket.DefaultMaxPayloadBytes
+	}
+	return &HTTPHandler{HTTPHandlerOpts: opts}, nil
+}
+
+func (self *HTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set(`Allow`, http.MethodPost)
+		http.Error(w, `method not allowed`, http.StatusMethodNotAllowed)
+		return
+	}
+	queryVersion, hasVersion, err := self.Router.queryVersion(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, int64(self.MaxMessageSize)+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > self.MaxMessageSize {
+		self.reply(w, http.StatusRequestEntityTooLarge, marshallPacket(JSONCodec, PacketOut{
+			Commands: apiErrorCommands(`message_too_large`, `message exceeds `+strconv.Itoa(self.MaxMessageSize)+` bytes`),
+		}))
+		return
+	}
+	self.Logger.Println(`IN:`, string(body))
+	// session is neither started nor resumed for packet which cannot be decoded
+	packet, err := JSONCodec.DecodePacket(body)
+	if err != nil {
+		self.reply(w, http.StatusBadRequest, parseErrorPacket(JSONCodec, err))
+		return
+	}
+
+	token := req.Header.Get(SessionTokenHeader)
+	if self.Sessions != nil && token != `` {
+		defer self.tokens.lock(token)()
+	}
+	conn := newHTTPConn(req.Context(), atomic.AddUint64(&self.lastID, 1), self.PushPolicy)
+	token = self.resume(conn, token)
+	if hasVersion {
+		conn.SetVersion(queryVersion)
+	}
+	out := self.Router.runCommands(conn, packet)
+	pushes := conn.finish()
+	if self.PubSub != nil {
+		self.PubSub.UnsubscribeAll(conn)
+	}
+	out.Commands = append(out.Commands, pushes...)
+	buf := self.Router.marshalReply(conn, out)
+	if self.Router.cmdLogger != nil {
+		self.Router.cmdLogger.LogRequest(conn.Session(), packet, out)
+	}
+	if token != `` && !conn.isClosed() {
+		w.Header().Set(SessionTokenHeader, token)
+	}
+	self.reply(w, http.StatusOK, buf)
+	self.end(conn, token)
+}
+
+// resume loads session of token into conn, or starts a new one, and returns token to store it by
+func (self *HTTPHandler) resume(conn *httpConn, token string) string {
+	if self.Sessions != nil && token != `` {
+		if stored, ok := self.Sessions.Load(token); ok {
+			conn.sess = stored.Session
+			conn.SetVersion(stored.Version)
+			return token
+		}
+	}
+	conn.sess = self.NewSessionFn()
+	if self.Sessions == nil {
+		return ``
+	}
+	return newSessionToken()
+}
+
+// end keeps session of token for next requests unless conn was closed by handler
+func (self *HTTPHandler) end(conn *httpConn, token string) {
+	switch {
+	case token == ``:
+		closeSession(conn.sess, ErrRequestDone)
+	case conn.isClosed():
+		self.Sessions.Delete(token)
+		closeSession(conn.sess, ErrClosedByServer)
+	default:
+		self.Sessions.Store(token, &StoredSession{
+			Session: conn.sess,
+			Version: conn.Version(),
+		})
+	}
+}
+
+func (self *HTTPHandler) reply(w http.ResponseWriter, status int, buf []byte) {
+	self.Logger.Println(`OUT:`, string(buf))
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.WriteHeader(status)
+	w.Write(buf)
+}
+
+func newSessionToken() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// httpConn lives while a single http request is served
+type httpConn struct {
+	id         uint64
+	version    int64
+	sess       interface{}
+	ctx        context.Context
+	cancel     context.CancelFunc
+	pushPolicy PushPolicy
+	mu         sync.Mutex
+	pushes     []CommandOut
+	done       bool
+	closed     bool
+}
+
+func newHTTPConn(ctx context.Context, id uint64, pushPolicy PushPolicy) *httpConn {
+	ctx, cancel := context.WithCancel(ctx)
+	return &httpConn{
+		id:         id,
+		ctx:        ctx,
+		cancel:     cancel,
+		pushPolicy: pushPolicy,
+	}
+}
+
+// finish returns buffered pushes, later ones fail with ErrConnectionClosed
+func (self *httpConn) finish() []CommandOut {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.done = true
+	self.cancel()
+	return self.pushes
+}
+
+func (self *httpConn) Send(cmds ...CmdNamer) error {
+	return self.push(commandsOut(cmds...))
+}
+
+func (self *httpConn) push(cmds []CommandOut) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.done || self.closed {
+		return ErrConnectionClosed
+	}
+	if self.pushPolicy != PushBuffer {
+		return ErrPushNotSupported
+	}
+	self.pushes = append(self.pushes, cmds...)
+	return nil
+}
+
+func (self *httpConn) send([]byte) error {
+	return ErrPushNotSupported
+}
+
+// sendPush takes broadcast and published pushes like Send
+func (self *httpConn) sendPush(packet *encodedPacket) error {
+	return self.push(packet.decoded().Commands)
+}
+
+func (self *httpConn) codec() Codec {
+	return JSONCodec
+}
+
+func (self *httpConn) Session() interface{} {
+	return self.sess
+}
+
+func (self *httpConn) SetSession(v interface{}) {
+	self.sess = v
+}
+
+func (self *httpConn) ID() uint64 {
+	return self.id
+}
+
+func (self *httpConn) Context() context.Context {
+	return self.ctx
+}
+
+func (self *httpConn) Version() int {
+	return int(atomic.LoadInt64(&self.version))
+}
+
+func (self *httpConn) SetVersion(v int) {
+	atomic.StoreInt64(&self.version, int64(v))
+}
+
+// Close ends session, it is not resumed by its token any more
+func (self *httpConn) Close() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.closed = true
+	self.cancel()
+}
+
+func (self *httpConn) isClosed() bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.closed
+}
@@ -0,0 +1,247 @@
+package apiserver_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/x12tech/go-websocketapi/apiserver"
+)
+
+type httpSession struct {
+	count   int
+	reasons chan error
+}
+
+func (self *httpSession) CloseWithReason(reason error) {
+	self.reasons <- reason
+}
+
+var _ = Describe("http handler", func() {
+	var (
+		router  *apiserver.Router
+		opts    apiserver.HTTPHandlerOpts
+		reasons chan error
+	)
+	BeforeEach(func() {
+		reasons = make(chan error, 4)
+		router = apiserver.NewRouter()
+		router.RegisterApiHandler(0, `cmdname`, func(conn apiserver.Conn, req *testEchoRequest) (*testEchoResponce, error) {
+			return &testEchoResponce{Pong: req.Ping}, nil
+		})
+		router.RegisterApiHandler(0, `push`, func(conn apiserver.Conn, req *testEchoRequest) (*testEchoResponce, error) {
+			if err := conn.Send(StillAlive{Ping: req.Ping}); err != nil {
+				return nil, err
+			}
+			return &testEchoResponce{Pong: req.Ping}, nil
+		})
+		router.RegisterApiHandler(0, `count`, func(conn apiserver.Conn, req *testEchoRequest) (*testEchoResponce, error) {
+			sess := conn.Session().(*httpSession)
+			sess.count++
+			return &testEchoResponce{Pong: strconv.Itoa(sess.count)}, nil
+		})
+		router.RegisterApiHandler(0, `logout`, func(conn apiserver.Conn, req *testEchoRequest) error {
+			conn.Close()
+			return nil
+		})
+		opts = apiserver.HTTPHandlerOpts{
+			Router: router,
+			NewSessionFn: func() interface{} {
+				return &httpSession{reasons: reasons}
+			},
+		}
+	})
+	post := func(opts apiserver.HTTPHandlerOpts, token, body string) *httptest.ResponseRecorder {
+		handler, err := apiserver.NewHTTPHandler(opts)
+		Expect(err).To(Succeed())
+		req := httptest.NewRequest(http.MethodPost, `/api`, strings.NewReader(body))
+		if token != `` {
+			req.Header.Set(apiserver.SessionTokenHeader, token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	It(`replies to posted packet`, func() {
+		rec := post(opts, ``, `{ "cid": 1, "cmds":[{ "name" : "cmdname", "data" : { "ping" : "text" } }]}`)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Header().Get(`Content-Type`)).To(Equal(`application/json`))
+		Expect(rec.Header().Get(apiserver.SessionTokenHeader)).To(BeEmpty())
+		Expect(rec.Body.String()).To(MatchJSON(`{ "cid": 1, "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "text" } }]}`))
+		Expect(reasons).To(Receive(Equal(apiserver.ErrRequestDone)))
+	})
+	It(`rejects pushes by default`, func() {
+		rec := post(opts, ``, `{ "cid": 1, "cmds":[{ "name" : "push", "data" : { "ping" : "text" } }]}`)
+		Expect(rec.Body.String()).To(MatchJSON(`{ "cid": 1, "cmds":[{ "name" : "Error", "data" : { "type" : "exec_error", "msg" : "push is not supported over http" } }]}`))
+	})
+	It(`appends buffered pushes to reply`, func() {
+		opts.PushPolicy = apiserver.PushBuffer
+		rec := post(opts, ``, `{ "cid": 1, "cmds":[{ "name" : "push", "data" : { "ping" : "text" } }]}`)
+		Expect(rec.Body.String()).To(MatchJSON(`{ "cid": 1, "cmds":[
+			{ "name" : "test_echo_responce", "data" : { "pong" : "text" } },
+			{ "name" : "StillAlive", "data" : { "ping" : "text" } }
+		]}`))
+	})
+	Describe(`pubsub`, func() {
+		var pubsub *apiserver.PubSub
+		subscribe := `{ "cmds":[{ "name" : "Subscribe", "data" : { "topic" : "t" } }]}`
+		BeforeEach(func() {
+			pubsub = apiserver.NewPubSub()
+			pubsub.Register(router, 0)
+			router.RegisterApiHandler(0, `publish`, func(conn apiserver.Conn, req *testEchoRequest) error {
+				_, err := pubsub.Publish(`t`, StillAlive{Ping: req.Ping})
+				return err
+			})
+		})
+		It(`drops subscriptions when request ends`, func() {
+			opts.PubSub = pubsub
+			for i := 0; i < 3; i++ {
+				Expect(post(opts, ``, subscribe).Code).To(Equal(http.StatusOK))
+			}
+			Expect(pubsub.Subscribers(`t`)).To(Equal(0))
+			Expect(pubsub.Publish(`t`, StillAlive{Ping: `late`})).To(Equal(0))
+		})
+		It(`unsubscribes finished requests on publish`, func() {
+			for i := 0; i < 3; i++ {
+				post(opts, ``, subscribe)
+			}
+			Expect(pubsub.Subscribers(`t`)).To(Equal(3))
+			Expect(pubsub.Publish(`t`, StillAlive{Ping: `late`})).To(Equal(0))
+			Expect(pubsub.Subscribers(`t`)).To(Equal(0))
+		})
+		It(`appends published pushes to reply`, func() {
+			opts.PubSub = pubsub
+			opts.PushPolicy = apiserver.PushBuffer
+			rec := post(opts, ``, `{ "cmds":[
+				{ "name" : "Subscribe", "data" : { "topic" : "t" } },
+				{ "name" : "publish", "data" : { "ping" : "news" } }
+			]}`)
+			Expect(rec.Body.String()).To(MatchJSON(`{ "cmds":[
+				{ "name" : "Subscribed", "data" : { "topic" : "t" } },
+				{ "name" : "StillAlive", "data" : { "ping" : "news" } }
+			]}`))
+		})
+	})
+	It(`resumes session by token`, func() {
+		opts.Sessions = apiserver.NewMemorySessionStore(apiserver.MemorySessionStoreOpts{})
+		count := `{ "cmds":[{ "name" : "count", "data" : {} }]}`
+		rec := post(opts, ``, count)
+		token := rec.Header().Get(apiserver.SessionTokenHeader)
+		Expect(token).NotTo(BeEmpty())
+		Expect(rec.Body.String()).To(MatchJSON(`{ "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "1" } }]}`))
+		rec = post(opts, token, count)
+		Expect(rec.Header().Get(apiserver.SessionTokenHeader)).To(Equal(token))
+		Expect(rec.Body.String()).To(MatchJSON(`{ "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "2" } }]}`))
+		Expect(reasons).NotTo(Receive())
+
+		rec = post(opts, token, `{ "cmds":[{ "name" : "logout", "data" : {} }]}`)
+		Expect(rec.Header().Get(apiserver.SessionTokenHeader)).To(BeEmpty())
+		Expect(reasons).To(Receive(Equal(apiserver.ErrClosedByServer)))
+		rec = post(opts, token, count)
+		Expect(rec.Header().Get(apiserver.SessionTokenHeader)).NotTo(Equal(token))
+		Expect(rec.Body.String()).To(MatchJSON(`{ "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "1" } }]}`))
+	})
+	It(`does not start session for packet which cannot be decoded`, func() {
+		opts.Sessions = apiserver.NewMemorySessionStore(apiserver.MemorySessionStoreOpts{})
+		rec := post(opts, ``, `not json`)
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		Expect(rec.Header().Get(apiserver.SessionTokenHeader)).To(BeEmpty())
+		Expect(reasons).NotTo(Receive())
+
+		count := `{ "cmds":[{ "name" : "count", "data" : {} }]}`
+		token := post(opts, ``, count).Header().Get(apiserver.SessionTokenHeader)
+		post(opts, token, `not json`)
+		rec = post(opts, token, count)
+		Expect(rec.Header().Get(apiserver.SessionTokenHeader)).To(Equal(token))
+		Expect(rec.Body.String()).To(MatchJSON(`{ "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "2" } }]}`))
+	})
+	It(`expires idle sessions`, func() {
+		opts.Sessions = apiserver.NewMemorySessionStore(apiserver.MemorySessionStoreOpts{IdleTimeout: 20 * time.Millisecond})
+		count := `{ "cmds":[{ "name" : "count", "data" : {} }]}`
+		token := post(opts, ``, count).Header().Get(apiserver.SessionTokenHeader)
+		time.Sleep(40 * time.Millisecond)
+		rec := post(opts, token, count)
+		Expect(reasons).To(Receive(Equal(apiserver.ErrSessionExpired)))
+		Expect(rec.Header().Get(apiserver.SessionTokenHeader)).NotTo(Equal(token))
+		Expect(rec.Body.String()).To(MatchJSON(`{ "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "1" } }]}`))
+	})
+	It(`evicts least recently used session beyond the limit`, func() {
+		opts.Sessions = apiserver.NewMemorySessionStore(apiserver.MemorySessionStoreOpts{MaxSessions: 2})
+		count := `{ "cmds":[{ "name" : "count", "data" : {} }]}`
+		first := post(opts, ``, count).Header().Get(apiserver.SessionTokenHeader)
+		second := post(opts, ``, count).Header().Get(apiserver.SessionTokenHeader)
+		post(opts, first, count)
+		post(opts, ``, count)
+		Expect(reasons).To(Receive(Equal(apiserver.ErrSessionExpired)))
+		Expect(post(opts, first, count).Header().Get(apiserver.SessionTokenHeader)).To(Equal(first))
+		Expect(post(opts, second, count).Header().Get(apiserver.SessionTokenHeader)).NotTo(Equal(second))
+	})
+	It(`serves requests of the same session one by one`, func() {
+		opts.Sessions = apiserver.NewMemorySessionStore(apiserver.MemorySessionStoreOpts{})
+		handler, err := apiserver.NewHTTPHandler(opts)
+		Expect(err).To(Succeed())
+		count := func(token string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodPost, `/api`, strings.NewReader(`{ "cmds":[{ "name" : "count", "data" : {} }]}`))
+			req.Header.Set(apiserver.SessionTokenHeader, token)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			return rec
+		}
+		token := count(``).Header().Get(apiserver.SessionTokenHeader)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				count(token)
+			}()
+		}
+		wg.Wait()
+		Expect(count(token).Body.String()).To(MatchJSON(`{ "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "12" } }]}`))
+	})
+	It(`keeps negotiated version in session`, func() {
+		router.EnableVersionNegotiation(1, 3)
+		router.RegisterApiHandler(2, `cmdname`, func(conn apiserver.Conn, req *testEchoRequest) (*testEchoResponce, error) {
+			return &testEchoResponce{Pong: `v2`}, nil
+		})
+		opts.Sessions = apiserver.NewMemorySessionStore(apiserver.MemorySessionStoreOpts{})
+		rec := post(opts, ``, `{ "cmds":[{ "name" : "Hello", "data" : { "version" : 2 } }]}`)
+		Expect(rec.Body.String()).To(MatchJSON(`{ "cmds":[{ "name" : "Hello", "data" : { "version" : 2, "minVersion" : 1, "maxVersion" : 3 } }]}`))
+		rec = post(opts, rec.Header().Get(apiserver.SessionTokenHeader), `{ "cmds":[{ "name" : "cmdname", "data" : { "ping" : "text" } }]}`)
+		Expect(rec.Body.String()).To(MatchJSON(`{ "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "v2" } }]}`))
+	})
+	It(`answers bad requests`, func() {
+		handler, err := apiserver.NewHTTPHandler(opts)
+		Expect(err).To(Succeed())
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, `/api`, nil))
+		Expect(rec.Code).To(Equal(http.StatusMethodNotAllowed))
+
+		rec = post(opts, ``, `not json`)
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		Expect(rec.Body.String()).To(ContainSubstring(`cannot parse command`))
+
+		opts.MaxMessageSize = 16
+		rec = post(opts, ``, `{ "cmds":[{ "name" : "cmdname", "data" : { "ping" : "text" } }]}`)
+		Expect(rec.Code).To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(rec.Body.String()).To(MatchJSON(`{ "cmds":[{ "name" : "Error", "data" : { "type" : "message_too_large", "msg" : "message exceeds 16 bytes" } }]}`))
+	})
+	It(`serves real http requests`, func() {
+		handler, err := apiserver.NewHTTPHandler(opts)
+		Expect(err).To(Succeed())
+		server := httptest.NewServer(handler)
+		defer server.Close()
+		resp, err := http.Post(server.URL, `application/json`, strings.NewReader(`{ "cid": 2, "cmds":[{ "name" : "cmdname", "data" : { "ping" : "curl" } }]}`))
+		Expect(err).To(Succeed())
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).To(Succeed())
+		Expect(body).To(MatchJSON(`{ "cid": 2, "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "curl" } }]}`))
+	})
+})
@@ -0,0 +1,81 @@
+package apiserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type activityKey struct{}
+
+// activity holds time of the last byte read from the peer, pongs included,
+// and the hijacked connection itself
+type activity struct {
+	lastRead int64
+	conn     net.Conn
+}
+
+func (self *activity) touch() {
+	atomic.StoreInt64(&self.lastRead, time.Now().UnixNano())
+}
+
+func (self *activity) LastRead() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&self.lastRead))
+}
+
+func activityFromRequest(req *http.Request) *activity {
+	if req == nil {
+		return nil
+	}
+	act, _ := req.Context().Value(activityKey{}).(*activity)
+	return act
+}
+
+func withActivity(req *http.Request, act *activity) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), activityKey{}, act))
+}
+
+// activityResponseWriter hands a read tracking connection to websocket handshake
+type activityResponseWriter struct {
+	http.ResponseWriter
+	act *activity
+}
+
+func (self *activityResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := self.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New(`ResponseWriter is not http.Hijacker`)
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	tracked := &activityConn{Conn: conn, act: self.act}
+	self.act.conn = tracked
+	var reader io.Reader = tracked
+	if n := rw.Reader.Buffered(); n > 0 {
+		buffered, _ := rw.Reader.Peek(n)
+		reader = io.MultiReader(bytes.NewReader(buffered), tracked)
+	}
+	return tracked, bufio.NewReadWriter(bufio.NewReader(reader), rw.Writer), nil
+}
+
+type activityConn struct {
+	net.Conn
+	act *activity
+}
+
+func (self *activityConn) Read(b []byte) (int, error) {
+	n, err := self.Conn.Read(b)
+	if n > 0 {
+		self.act.touch()
+	}
+	return n, err
+}
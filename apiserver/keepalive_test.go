@@ -0,0 +1,75 @@
+package apiserver_test
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/x12tech/go-websocketapi/apiserver"
+)
+
+type reasonSession struct {
+	reasons chan error
+}
+
+func (self *reasonSession) CloseWithReason(reason error) {
+	self.reasons <- reason
+}
+
+var _ = Describe("keepalive", func() {
+	var (
+		httpserver *http.Server
+		reasons    chan error
+	)
+	BeforeEach(func() {
+		reasons = make(chan error, 1)
+	})
+	AfterEach(func() {
+		httpserver.Shutdown(context.Background())
+	})
+	var Connect = func(opts apiserver.ServerOpts) *ApiClient {
+		opts.Router = apiserver.NewRouter()
+		opts.NewSessionFn = func() interface{} {
+			return &reasonSession{reasons: reasons}
+		}
+		var port int
+		_, httpserver, port = startServer(opts)
+		c, err := Dial(`127.0.0.1:` + strconv.Itoa(port))
+		Expect(err).To(Succeed())
+		return c
+	}
+	It(`closes connection when peer does not answer pings`, func() {
+		c := Connect(apiserver.ServerOpts{
+			PingInterval: 20 * time.Millisecond,
+			PongTimeout:  20 * time.Millisecond,
+		})
+		defer c.ws.Close()
+		Eventually(reasons).Should(Receive(Equal(apiserver.ErrPongTimeout)))
+	})
+	It(`keeps connection answering pings alive`, func() {
+		c := Connect(apiserver.ServerOpts{
+			PingInterval: 20 * time.Millisecond,
+			PongTimeout:  20 * time.Millisecond,
+		})
+		go func() {
+			for {
+				if _, err := c.Await(); err != nil {
+					return
+				}
+			}
+		}()
+		Consistently(reasons, 200*time.Millisecond).ShouldNot(Receive())
+		c.ws.Close()
+		Eventually(reasons).Should(Receive(Equal(apiserver.ErrPeerClosed)))
+	})
+	It(`closes idle connection`, func() {
+		c := Connect(apiserver.ServerOpts{
+			IdleTimeout: 50 * time.Millisecond,
+		})
+		defer c.ws.Close()
+		Eventually(reasons).Should(Receive(Equal(apiserver.ErrIdleTimeout)))
+	})
+})
@@ -0,0 +1,314 @@
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// pipe carries packets between server and client ends in memory
+type pipe struct {
+	toServer    chan []byte
+	toClient    chan []byte
+	done        chan struct{}
+	closeOnce   sync.Once
+	closeReason string
+}
+
+func newPipe() *pipe {
+	return &pipe{
+		toServer: make(chan []byte),
+		toClient: make(chan []byte),
+		done:     make(chan struct{}),
+	}
+}
+
+func (self *pipe) close(reason string) {
+	self.closeOnce.Do(func() {
+		self.closeReason = reason
+		close(self.done)
+	})
+}
+
+func (self *pipe) receive(in <-chan []byte, deadline time.Time) ([]byte, error) {
+	expired, stop := deadlineTimer(deadline)
+	defer stop()
+	select {
+	case buf := <-in:
+		return buf, nil
+	case <-self.done:
+		return nil, io.EOF
+	case <-expired:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (self *pipe) deliver(out chan<- []byte, buf []byte, deadline time.Time) error {
+	expired, stop := deadlineTimer(deadline)
+	defer stop()
+	select {
+	case out <- buf:
+		return nil
+	case <-self.done:
+		return ErrConnectionClosed
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// pipeTransport is the server end of pipe
+type pipeTransport struct {
+	pipe          *pipe
+	opts          TransportOpts
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// Request is nil, as there is no http request behind pipe
+func (self *pipeTransport) Request() *http.Request {
+	return nil
+}
+
+func (self *pipeTransport) Subprotocol() string {
+	return ``
+}
+
+func (self *pipeTransport) ReadMessage() ([]byte, error) {
+	buf, err := self.pipe.receive(self.pipe.toServer, self.readDeadline)
+	if err == nil && self.opts.MaxMessageSize > 0 && len(buf) > self.opts.MaxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+	return buf, err
+}
+
+func (self *pipeTransport) WriteMessage(buf []byte, binary bool) error {
+	return self.pipe.deliver(self.pipe.toClient, buf, self.writeDeadline)
+}
+
+func (self *pipeTransport) Ping() error {
+	return nil
+}
+
+func (self *pipeTransport) LastRead() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (self *pipeTransport) SetReadDeadline(t time.Time) error {
+	self.readDeadline = t
+	return nil
+}
+
+func (self *pipeTransport) SetWriteDeadline(t time.Time) error {
+	self.writeDeadline = t
+	return nil
+}
+
+func (self *pipeTransport) Close(code int, reason string) error {
+	self.pipe.close(reason)
+	return nil
+}
+
+// Pipe connects an in-memory client to server, no sockets are involved.
+// Returned Conn is the server side of connection, it is served like any other one.
+func (self *Server) Pipe() (Conn, *PipeClient) {
+	p := newPipe()
+	client := newPipeClient(p, self.log)
+	conn := self.accept(&pipeTransport{pipe: p, opts: self.transportOpts})
+	if conn == nil {
+		return nil, client
+	}
+	go conn.Start()
+	return conn, client
+}
+
+// Pipe serves router to an in-memory client with default ServerOpts, server is returned to be shut down
+// once client is not needed
+func Pipe(router *Router) (*Server, Conn, *PipeClient) {
+	server, err := NewServer(ServerOpts{Router: router})
+	if err != nil {
+		panic(err)
+	}
+	conn, client := server.Pipe()
+	return server, conn, client
+}
+
+// ReplyCommand is a command received by client, its data is left JSON encoded
+type ReplyCommand struct {
+	Name string          `json:"name"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type replyPacket struct {
+	Commands []ReplyCommand `json:"cmds"`
+	Cid      int32          `json:"cid,omitempty"`
+}
+
+// pipeClientPushes is how many pushes are buffered until Receive, further ones are dropped
+const pipeClientPushes = 64
+
+// PipeClient is the client end of Pipe
+type PipeClient struct {
+	pipe    *pipe
+	log     Logger
+	lastCid int32
+	mu      sync.Mutex
+	pending map[int32]chan []ReplyCommand
+	pushes  chan []ReplyCommand
+	// stopped is closed when every packet received is dispatched
+	stopped chan struct{}
+}
+
+func newPipeClient(p *pipe, log Logger) *PipeClient {
+	self := &PipeClient{
+		pipe:    p,
+		log:     log,
+		pending: make(map[int32]chan []ReplyCommand),
+		pushes:  make(chan []ReplyCommand, pipeClientPushes),
+		stopped: make(chan struct{}),
+	}
+	go self.readLoop()
+	return self
+}
+
+func (self *PipeClient) readLoop() {
+	defer close(self.stopped)
+	for {
+		buf, err := self.pipe.receive(self.pipe.toClient, time.Time{})
+		if err != nil {
+			return
+		}
+		var packet replyPacket
+		if err := json.Unmarshal(buf, &packet); err != nil {
+			continue
+		}
+		self.mu.Lock()
+		reply, ok := self.pending[packet.Cid]
+		delete(self.pending, packet.Cid)
+		self.mu.Unlock()
+		if ok {
+			reply <- packet.Commands
+			continue
+		}
+		// replies are never held up by pushes nobody receives
+		select {
+		case self.pushes <- packet.Commands:
+		default:
+			self.log.Println(`pipe client push dropped, buffer is full`)
+		}
+	}
+}
+
+// Call sends command with data and waits for reply, Error command of reply is returned as *ErrorCommand
+func (self *PipeClient) Call(ctx context.Context, command string, data interface{}) ([]ReplyCommand, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, errors.Wrap(err, `marshal data`)
+	}
+	cid := self.nextCid()
+	buf, err := json.Marshal(PacketIn{
+		Cid:      cid,
+		Commands: []CommandIn{{Name: command, Data: raw}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	reply := make(chan []ReplyCommand, 1)
+	self.mu.Lock()
+	self.pending[cid] = reply
+	self.mu.Unlock()
+	defer func() {
+		self.mu.Lock()
+		delete(self.pending, cid)
+		self.mu.Unlock()
+	}()
+	if err := self.Send(ctx, buf); err != nil {
+		return nil, err
+	}
+	var cmds []ReplyCommand
+	select {
+	case cmds = <-reply:
+	case <-self.stopped:
+		// reply may arrive right before connection is closed
+		select {
+		case cmds = <-reply:
+		default:
+			return nil, ErrConnectionClosed
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	for _, cmd := range cmds {
+		if cmd.Name == (ErrorCommand{}).CmdName() {
+			errCmd := new(ErrorCommand)
+			if err := json.Unmarshal(cmd.Data, errCmd); err != nil {
+				return nil, errors.Wrap(err, `unmarshal error`)
+			}
+			return cmds, errCmd
+		}
+	}
+	return cmds, nil
+}
+
+// nextCid skips zero on wraparound, as reply without cid is a push
+func (self *PipeClient) nextCid() int32 {
+	for {
+		if cid := atomic.AddInt32(&self.lastCid, 1); cid != 0 {
+			return cid
+		}
+	}
+}
+
+// Send sends raw packet
+func (self *PipeClient) Send(ctx context.Context, buf []byte) error {
+	select {
+	case self.pipe.toServer <- buf:
+		return nil
+	case <-self.pipe.done:
+		return ErrConnectionClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Receive returns commands of the next packet pushed by server
+func (self *PipeClient) Receive(ctx context.Context) ([]ReplyCommand, error) {
+	select {
+	case cmds := <-self.pushes:
+		return cmds, nil
+	default:
+	}
+	select {
+	case cmds := <-self.pushes:
+		return cmds, nil
+	case <-self.pipe.done:
+		return nil, ErrConnectionClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Done is closed when connection is closed by either side
+func (self *PipeClient) Done() <-chan struct{} {
+	return self.pipe.done
+}
+
+// CloseReason tells why server closed connection, it is known once Done is closed
+func (self *PipeClient) CloseReason() string {
+	select {
+	case <-self.pipe.done:
+		return self.pipe.closeReason
+	default:
+		return ``
+	}
+}
+
+func (self *PipeClient) Close() {
+	self.pipe.close(ErrPeerClosed.Error())
+}
@@ -0,0 +1,101 @@
+package apiserver_test
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/x12tech/go-websocketapi/apiserver"
+)
+
+var _ = Describe("pipe", func() {
+	var (
+		router *apiserver.Router
+		ctx    context.Context
+	)
+	BeforeEach(func() {
+		ctx = context.Background()
+		router = apiserver.NewRouter()
+		router.RegisterApiHandler(0, `cmdname`, func(conn apiserver.Conn, req *testEchoRequest) (*testEchoResponce, error) {
+			conn.Send(StillAlive{Ping: `pushed`})
+			return &testEchoResponce{Pong: req.Ping}, nil
+		})
+	})
+	It(`calls router and receives pushes`, func() {
+		server, conn, client := apiserver.Pipe(router)
+		defer server.Shutdown(ctx)
+		Expect(conn).NotTo(BeNil())
+		reply, err := client.Call(ctx, `cmdname`, testEchoRequest{Ping: `pipe`})
+		Expect(err).To(Succeed())
+		Expect(reply).To(HaveLen(1))
+		Expect(reply[0].Name).To(Equal(`test_echo_responce`))
+		Expect(reply[0].Data).To(MatchJSON(`{ "pong" : "pipe" }`))
+		push, err := client.Receive(ctx)
+		Expect(err).To(Succeed())
+		Expect(push[0].Name).To(Equal(`StillAlive`))
+		Expect(push[0].Data).To(MatchJSON(`{ "ping" : "pushed" }`))
+	})
+	It(`returns Error reply as error`, func() {
+		server, _, client := apiserver.Pipe(router)
+		defer server.Shutdown(ctx)
+		_, err := client.Call(ctx, `unknown`, nil)
+		Expect(err).To(Equal(apiserver.ApiError(`command_handler_not_found`, `command_handler_not_found at all`)))
+	})
+	It(`drops pushes beyond buffer instead of blocking replies`, func() {
+		router.RegisterApiHandler(0, `flood`, func(conn apiserver.Conn, req *testEchoRequest) (*testEchoResponce, error) {
+			for i := 0; i < 100; i++ {
+				conn.Send(StillAlive{Ping: strconv.Itoa(i)})
+			}
+			return &testEchoResponce{Pong: req.Ping}, nil
+		})
+		server, _, client := apiserver.Pipe(router)
+		defer server.Shutdown(ctx)
+		callCtx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		reply, err := client.Call(callCtx, `flood`, testEchoRequest{Ping: `flooded`})
+		Expect(err).To(Succeed())
+		Expect(reply[0].Data).To(MatchJSON(`{ "pong" : "flooded" }`))
+		push, err := client.Receive(ctx)
+		Expect(err).To(Succeed())
+		Expect(push[0].Data).To(MatchJSON(`{ "ping" : "0" }`))
+	})
+	It(`is served like other connections`, func() {
+		reasons := make(chan error, 1)
+		server, err := apiserver.NewServer(apiserver.ServerOpts{
+			Router: router,
+			NewSessionFn: func() interface{} {
+				return &reasonSession{reasons: reasons}
+			},
+		})
+		Expect(err).To(Succeed())
+		conn, client := server.Pipe()
+		Expect(server.Count()).To(Equal(1))
+		Expect(server.BroadcastAll(StillAlive{Ping: `everyone`})).To(Succeed())
+		push, err := client.Receive(ctx)
+		Expect(err).To(Succeed())
+		Expect(push[0].Data).To(MatchJSON(`{ "ping" : "everyone" }`))
+
+		conn.Close()
+		Eventually(client.Done()).Should(BeClosed())
+		Expect(client.CloseReason()).To(Equal(apiserver.ErrClosedByServer.Error()))
+		Expect(reasons).To(Receive(Equal(apiserver.ErrClosedByServer)))
+		_, err = client.Call(ctx, `cmdname`, testEchoRequest{})
+		Expect(err).To(Equal(apiserver.ErrConnectionClosed))
+	})
+	It(`closes server side when client closes`, func() {
+		reasons := make(chan error, 1)
+		server, err := apiserver.NewServer(apiserver.ServerOpts{
+			Router: router,
+			NewSessionFn: func() interface{} {
+				return &reasonSession{reasons: reasons}
+			},
+		})
+		Expect(err).To(Succeed())
+		_, client := server.Pipe()
+		client.Close()
+		Eventually(reasons).Should(Receive(Equal(apiserver.ErrPeerClosed)))
+		Eventually(server.Count).Should(Equal(0))
+	})
+})
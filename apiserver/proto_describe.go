@@ -0,0 +1,106 @@
+package apiserver
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const protoEnvelope = `// PacketIn is sent by client, cid is echoed in reply
+message PacketIn {
+  int32 cid = 1;
+  repeated CommandIn cmds = 2;
+}
+
+message CommandIn {
+  string name = 1;
+  // data is encoded request of Commands service method called name
+  bytes data = 2;
+}
+
+// PacketOut is a reply with cid of PacketIn or a push without cid
+message PacketOut {
+  int32 cid = 1;
+  repeated CommandOut cmds = 2;
+}
+
+message CommandOut {
+  string name = 1;
+  bytes data = 2;
+}
+`
+
+// DescribeProto returns .proto file of ProtobufCodec envelope and Commands service
+// which has a method per command with its data and reply types.
+// Types which are not proto.Message are described as google.protobuf.Struct.
+func (self *Router) DescribeProto(pkg string) string {
+	imports := make(map[string]struct{})
+	names := make([]string, 0, len(self.commandHandlers))
+	for name := range self.commandHandlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	service := &strings.Builder{}
+	service.WriteString("// Commands lists commands of API, replies are sent as CommandOut named after reply type\n")
+	service.WriteString("service Commands {\n")
+	for _, name := range names {
+		handler := (*self.commandHandlers[name])[0].Handler
+		replies := make([]string, 0, len(handler.Output))
+		replyTypes := make([]string, 0, len(handler.Output))
+		for _, out := range handler.Output {
+			typ := out.typ
+			if out.isSlice {
+				typ = out.elemType
+			}
+			replies = append(replies, reflect.New(typ).Interface().(CmdNamer).CmdName())
+			replyTypes = append(replyTypes, protoTypeName(typ, imports))
+		}
+		if len(replies) > 0 {
+			service.WriteString("  // replies " + strings.Join(replies, `, `) + "\n")
+		}
+		reply := `google.protobuf.Empty`
+		if len(replyTypes) > 0 {
+			reply = replyTypes[0]
+		} else {
+			imports[`google/protobuf/empty.proto`] = struct{}{}
+		}
+		service.WriteString("  rpc " + name + "(" + protoTypeName(handler.Input, imports) + ") returns (" + reply + ");\n")
+	}
+	service.WriteString("}\n")
+
+	out := &strings.Builder{}
+	out.WriteString("syntax = \"proto3\";\n\n")
+	out.WriteString("package " + pkg + ";\n\n")
+	paths := make([]string, 0, len(imports))
+	for path := range imports {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		out.WriteString("import \"" + path + "\";\n")
+	}
+	if len(paths) > 0 {
+		out.WriteString("\n")
+	}
+	out.WriteString(protoEnvelope)
+	out.WriteString("\n")
+	out.WriteString(service.String())
+	return out.String()
+}
+
+func protoTypeName(t reflect.Type, imports map[string]struct{}) string {
+	if t == nil {
+		imports[`google/protobuf/empty.proto`] = struct{}{}
+		return `google.protobuf.Empty`
+	}
+	if msg, ok := reflect.New(t).Interface().(proto.Message); ok {
+		descr := msg.ProtoReflect().Descriptor()
+		imports[descr.ParentFile().Path()] = struct{}{}
+		return string(descr.FullName())
+	}
+	imports[`google/protobuf/struct.proto`] = struct{}{}
+	return `google.protobuf.Struct`
+}
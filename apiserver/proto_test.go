@@ -0,0 +1,126 @@
+package apiserver_test
+
+import (
+	"context"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/x12tech/go-websocketapi/apiserver"
+	"golang.org/x/net/websocket"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type protoPing struct {
+	wrapperspb.StringValue
+}
+
+type protoPong struct {
+	wrapperspb.StringValue
+}
+
+func (*protoPong) CmdName() string {
+	return `proto_pong`
+}
+
+func protoPacketIn(cid int32, name string, data proto.Message) []byte {
+	cmd := protowire.AppendTag(nil, 1, protowire.BytesType)
+	cmd = protowire.AppendString(cmd, name)
+	if data != nil {
+		buf, err := proto.Marshal(data)
+		Expect(err).To(Succeed())
+		cmd = protowire.AppendTag(cmd, 2, protowire.BytesType)
+		cmd = protowire.AppendBytes(cmd, buf)
+	}
+	packet := protowire.AppendTag(nil, 1, protowire.VarintType)
+	packet = protowire.AppendVarint(packet, uint64(cid))
+	packet = protowire.AppendTag(packet, 2, protowire.BytesType)
+	return protowire.AppendBytes(packet, cmd)
+}
+
+var _ = Describe("protobuf", func() {
+	var (
+		router *apiserver.Router
+	)
+	BeforeEach(func() {
+		router = apiserver.NewRouter()
+		router.RegisterApiHandler(0, `proto_ping`, func(conn apiserver.Conn, req *protoPing) (*protoPong, error) {
+			pong := &protoPong{}
+			pong.Value = req.Value
+			return pong, nil
+		})
+		router.RegisterApiHandler(0, `cmdname`, func(conn apiserver.Conn, req *testEchoRequest) (*testEchoResponce, error) {
+			return &testEchoResponce{Pong: req.Ping}, nil
+		})
+	})
+	It(`passes proto messages to handlers and back`, func() {
+		_, httpserver, port := startServer(apiserver.ServerOpts{
+			Router: router,
+		})
+		defer httpserver.Shutdown(context.Background())
+		c := DialProtocol(`127.0.0.1:`+strconv.Itoa(port), `protobuf`)
+		defer c.ws.Close()
+		c.ws.PayloadType = websocket.BinaryFrame
+		Expect(c.Send(protoPacketIn(5, `proto_ping`, wrapperspb.String(`hello`)))).To(Succeed())
+
+		reply, err := apiserver.ProtobufCodec.DecodePacket(must(c.Await()))
+		Expect(err).To(Succeed())
+		Expect(reply.Cid).To(Equal(int32(5)))
+		Expect(reply.Commands).To(HaveLen(1))
+		Expect(reply.Commands[0].Name).To(Equal(`proto_pong`))
+		pong := &wrapperspb.StringValue{}
+		Expect(proto.Unmarshal(reply.Commands[0].Data, pong)).To(Succeed())
+		Expect(pong.Value).To(Equal(`hello`))
+	})
+	It(`sends other data as google.protobuf.Struct`, func() {
+		conn := apiserver.NewFakeConn()
+		conn.CodecValue = apiserver.ProtobufCodec
+		data, err := structpb.NewStruct(map[string]interface{}{`ping`: `struct`})
+		Expect(err).To(Succeed())
+		router.ProcessPacket(conn, protoPacketIn(1, `cmdname`, data))
+		router.ProcessPacket(conn, protoPacketIn(2, `unknown`, nil))
+
+		reply, err := apiserver.ProtobufCodec.DecodePacket(conn.Written[0])
+		Expect(err).To(Succeed())
+		Expect(reply.Commands[0].Name).To(Equal(`test_echo_responce`))
+		s := &structpb.Struct{}
+		Expect(proto.Unmarshal(reply.Commands[0].Data, s)).To(Succeed())
+		Expect(s.AsMap()).To(Equal(map[string]interface{}{`pong`: `struct`}))
+
+		reply, err = apiserver.ProtobufCodec.DecodePacket(conn.Written[1])
+		Expect(err).To(Succeed())
+		Expect(reply.Cid).To(Equal(int32(2)))
+		Expect(reply.Commands[0].Name).To(Equal(`Error`))
+		Expect(proto.Unmarshal(reply.Commands[0].Data, s)).To(Succeed())
+		Expect(s.AsMap()).To(HaveKeyWithValue(`type`, `command_handler_not_found`))
+	})
+	It(`rejects unknown fields of proto messages in strict mode`, func() {
+		router.EnableStrictDecoding(0)
+		conn := apiserver.NewFakeConn()
+		conn.CodecValue = apiserver.ProtobufCodec
+		router.ProcessPacket(conn, protoPacketIn(1, `proto_ping`, wrapperspb.Int64(12)))
+
+		reply, err := apiserver.ProtobufCodec.DecodePacket(conn.Written[0])
+		Expect(err).To(Succeed())
+		s := &structpb.Struct{}
+		Expect(proto.Unmarshal(reply.Commands[0].Data, s)).To(Succeed())
+		Expect(s.AsMap()).To(Equal(map[string]interface{}{`type`: `unknown_field`, `msg`: `unknown field 1`}))
+	})
+	It(`describes commands in .proto file`, func() {
+		descr := router.DescribeProto(`api`)
+		Expect(descr).To(HavePrefix("syntax = \"proto3\";\n\npackage api;\n\n" +
+			"import \"google/protobuf/struct.proto\";\n" +
+			"import \"google/protobuf/wrappers.proto\";\n"))
+		Expect(descr).To(ContainSubstring("message PacketIn {\n  int32 cid = 1;\n  repeated CommandIn cmds = 2;\n}"))
+		Expect(descr).To(ContainSubstring(
+			"service Commands {\n" +
+				"  // replies test_echo_responce\n" +
+				"  rpc cmdname(google.protobuf.Struct) returns (google.protobuf.Struct);\n" +
+				"  // replies proto_pong\n" +
+				"  rpc proto_ping(google.protobuf.StringValue) returns (google.protobuf.StringValue);\n" +
+				"}\n"))
+	})
+})
@@ -0,0 +1,196 @@
+package apiserver
+
+import (
+	"sync"
+)
+
+// TopicAuthorizer decides whether conn may subscribe to topic, non nil error denies it
+type TopicAuthorizer func(conn Conn, topic string) error
+
+type TopicRequest struct {
+	Topic string `json:"topic"`
+}
+
+type SubscribedCommand struct {
+	Topic string `json:"topic"`
+}
+
+func (SubscribedCommand) CmdName() string {
+	return `Subscribed`
+}
+
+type UnsubscribedCommand struct {
+	Topic string `json:"topic"`
+}
+
+func (UnsubscribedCommand) CmdName() string {
+	return `Unsubscribed`
+}
+
+// PubSub delivers published commands to connections subscribed to a topic.
+// Pass it to ServerOpts to drop subscriptions of closed connections.
+type PubSub struct {
+	mu         sync.RWMutex
+	topics     map[string]map[Conn]struct{}
+	conns      map[Conn]map[string]struct{}
+	authorize  TopicAuthorizer
+	log        Logger
+	broker     Broker
+	brokerSubs map[string]func()
+	origin     string
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{
+		topics:     make(map[string]map[Conn]struct{}),
+		conns:      make(map[Conn]map[string]struct{}),
+		log:        &EmptyLogger{},
+		brokerSubs: make(map[string]func()),
+		origin:     newOrigin(),
+	}
+}
+
+// SetBroker makes Publish reach subscribers on every node sharing the broker.
+// It must be called before any subscription is made.
+func (self *PubSub) SetBroker(b Broker) {
+	self.broker = b
+}
+
+func (self *PubSub) SetAuthorizer(fn TopicAuthorizer) {
+	self.authorize = fn
+}
+
+func (self *PubSub) SetLogger(l Logger) {
+	self.log = l
+}
+
+// Register adds Subscribe and Unsubscribe commands to router
+func (self *PubSub) Register(router IRouter, version int) {
+	router.RegisterApiHandler(version, `Subscribe`, self.HandleSubscribe)
+	router.RegisterApiHandler(version, `Unsubscribe`, self.HandleUnsubscribe)
+}
+
+func (self *PubSub) HandleSubscribe(conn Conn, req *TopicRequest) (*SubscribedCommand, error) {
+	if err := self.Subscribe(conn, req.Topic); err != nil {
+		return nil, err
+	}
+	return &SubscribedCommand{Topic: req.Topic}, nil
+}
+
+func (self *PubSub) HandleUnsubscribe(conn Conn, req *TopicRequest) (*UnsubscribedCommand, error) {
+	self.Unsubscribe(conn, req.Topic)
+	return &UnsubscribedCommand{Topic: req.Topic}, nil
+}
+
+func (self *PubSub) Subscribe(conn Conn, topic string) error {
+	if topic == `` {
+		return ApiError(`invalid_topic`, `topic is empty`)
+	}
+	if self.authorize != nil {
+		if err := self.authorize(conn, topic); err != nil {
+			if errCmd, ok := err.(*ErrorCommand); ok {
+				return errCmd
+			}
+			return ApiError(`forbidden`, err.Error())
+		}
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	subscribers := self.topics[topic]
+	if subscribers == nil {
+		if self.broker != nil {
+			cancel, err := self.broker.Subscribe(topicChannel(topic), func(payload []byte) {
+				if packet := decodeBrokerMessage(self.origin, payload); packet != nil {
+					self.deliver(topic, packet)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			self.brokerSubs[topic] = cancel
+		}
+		subscribers = make(map[Conn]struct{})
+		self.topics[topic] = subscribers
+	}
+	subscribers[conn] = struct{}{}
+	topics := self.conns[conn]
+	if topics == nil {
+		topics = make(map[string]struct{})
+		self.conns[conn] = topics
+	}
+	topics[topic] = struct{}{}
+	return nil
+}
+
+func (self *PubSub) Unsubscribe(conn Conn, topic string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.unsubscribe(conn, topic)
+}
+
+// UnsubscribeAll drops every subscription of conn
+func (self *PubSub) UnsubscribeAll(conn Conn) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for topic := range self.conns[conn] {
+		self.unsubscribe(conn, topic)
+	}
+}
+
+func (self *PubSub) unsubscribe(conn Conn, topic string) {
+	if subscribers, ok := self.topics[topic]; ok {
+		delete(subscribers, conn)
+		if len(subscribers) == 0 {
+			delete(self.topics, topic)
+			if cancel, ok := self.brokerSubs[topic]; ok {
+				cancel()
+				delete(self.brokerSubs, topic)
+			}
+		}
+	}
+	if topics, ok := self.conns[conn]; ok {
+		delete(topics, topic)
+		if len(topics) == 0 {
+			delete(self.conns, conn)
+		}
+	}
+}
+
+// Subscribers returns number of connections subscribed to topic
+func (self *PubSub) Subscribers(topic string) int {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return len(self.topics[topic])
+}
+
+// Publish sends cmds to every connection subscribed to topic and returns number of them on this node.
+// If broker is set cmds are published to other nodes too, error tells that it failed.
+func (self *PubSub) Publish(topic string, cmds ...CmdNamer) (int, error) {
+	packet := newEncodedPacket(pushPacket(cmds...))
+	sent := self.deliver(topic, packet)
+	if self.broker != nil {
+		return sent, self.broker.Publish(topicChannel(topic), encodeBrokerMessage(self.origin, packet))
+	}
+	return sent, nil
+}
+
+func (self *PubSub) deliver(topic string, packet *encodedPacket) int {
+	self.mu.RLock()
+	conns := make([]Conn, 0, len(self.topics[topic]))
+	for conn := range self.topics[topic] {
+		conns = append(conns, conn)
+	}
+	self.mu.RUnlock()
+	sent := 0
+	for _, conn := range conns {
+		if err := conn.sendPush(packet); err != nil {
+			self.log.Println(`publish to`, topic, `failed:`, err)
+			if err == ErrConnectionClosed {
+				self.UnsubscribeAll(conn)
+			}
+			continue
+		}
+		sent++
+	}
+	return sent
+}
@@ -0,0 +1,112 @@
+package apiserver_test
+
+import (
+	"context"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	"github.com/x12tech/go-websocketapi/apiserver"
+)
+
+var _ = Describe("pubsub", func() {
+	var (
+		router *apiserver.Router
+		pubsub *apiserver.PubSub
+	)
+	BeforeEach(func() {
+		router = apiserver.NewRouter()
+		pubsub = apiserver.NewPubSub()
+		pubsub.Register(router, 0)
+	})
+	var Written = func(conn *apiserver.FakeConn) []string {
+		conn.Mu.Lock()
+		defer conn.Mu.Unlock()
+		out := make([]string, 0, len(conn.Written))
+		for _, buf := range conn.Written {
+			out = append(out, string(buf))
+		}
+		return out
+	}
+	It(`publishes to subscribers only`, func() {
+		subscriber := apiserver.NewFakeConn()
+		other := apiserver.NewFakeConn()
+		router.ProcessPacket(subscriber, []byte(`{ "cid": 1, "cmds":[{ "name" : "Subscribe", "data" : { "topic" : "entity/1" } }]}`))
+		router.ProcessPacket(other, []byte(`{ "cid": 1, "cmds":[{ "name" : "Subscribe", "data" : { "topic" : "entity/2" } }]}`))
+		Expect(Written(subscriber)[0]).To(MatchJSON(`{ "cid": 1, "cmds":[{ "name" : "Subscribed", "data" : { "topic" : "entity/1" } }]}`))
+
+		Expect(pubsub.Publish(`entity/1`, StillAlive{Ping: `updated`})).To(Equal(1))
+		Expect(Written(subscriber)).To(HaveLen(2))
+		Expect(Written(subscriber)[1]).To(MatchJSON(`{ "cmds": [{  "name" : "StillAlive", "data":{"ping":"updated"} }]}`))
+		Expect(Written(other)).To(HaveLen(1))
+
+		router.ProcessPacket(subscriber, []byte(`{ "cid": 2, "cmds":[{ "name" : "Unsubscribe", "data" : { "topic" : "entity/1" } }]}`))
+		Expect(Written(subscriber)[2]).To(MatchJSON(`{ "cid": 2, "cmds":[{ "name" : "Unsubscribed", "data" : { "topic" : "entity/1" } }]}`))
+		Expect(pubsub.Subscribers(`entity/1`)).To(Equal(0))
+		Expect(pubsub.Publish(`entity/1`, StillAlive{Ping: `updated`})).To(Equal(0))
+		Expect(Written(subscriber)).To(HaveLen(3))
+	})
+	It(`asks authorizer`, func() {
+		pubsub.SetAuthorizer(func(conn apiserver.Conn, topic string) error {
+			if topic == `secret` {
+				return errors.New(`no access to secret`)
+			}
+			return nil
+		})
+		conn := apiserver.NewFakeConn()
+		router.ProcessPacket(conn, []byte(`{ "cid": 1, "cmds":[{ "name" : "Subscribe", "data" : { "topic" : "secret" } }]}`))
+		Expect(Written(conn)[0]).To(MatchJSON(`{ "cid": 1, "cmds":[{ "name" : "Error", "data" : { "type" : "forbidden", "msg" : "no access to secret" } }]}`))
+		Expect(pubsub.Subscribers(`secret`)).To(Equal(0))
+	})
+	It(`drops subscriptions of closed connections`, func() {
+		router.RegisterApiHandler(0, `notify`, func(conn apiserver.Conn) error {
+			pubsub.Publish(`news`, StillAlive{Ping: `news`})
+			return nil
+		})
+		_, httpserver, port := startServer(apiserver.ServerOpts{
+			Router: router,
+			PubSub: pubsub,
+		})
+		defer httpserver.Shutdown(context.Background())
+		c, err := Dial(`127.0.0.1:` + strconv.Itoa(port))
+		Expect(err).To(Succeed())
+		Expect(c.Send([]byte(`{ "cid": 1, "cmds":[{ "name" : "Subscribe", "data" : { "topic" : "news" } }]}`))).To(Succeed())
+		Expect(c.Await()).To(MatchJSON(`{ "cid": 1, "cmds":[{ "name" : "Subscribed", "data" : { "topic" : "news" } }]}`))
+		Expect(pubsub.Subscribers(`news`)).To(Equal(1))
+		Expect(c.Send([]byte(`{ "cid": 2, "cmds":[{ "name" : "notify" }]}`))).To(Succeed())
+		Expect(c.Await()).To(MatchJSON(`{ "cmds": [{  "name" : "StillAlive", "data":{"ping":"news"} }]}`))
+		Expect(c.Await()).To(MatchJSON(`{ "cid": 2, "cmds": null}`))
+
+		Expect(c.ws.Close()).To(Succeed())
+		Eventually(func() int { return pubsub.Subscribers(`news`) }).Should(Equal(0))
+	})
+	It(`logs published and broadcast pushes`, func() {
+		logger := &pushLogger{pushes: make(chan string, 2)}
+		server, httpserver, port := startServer(apiserver.ServerOpts{
+			Router:    router,
+			PubSub:    pubsub,
+			CmdLogger: logger,
+		})
+		defer httpserver.Shutdown(context.Background())
+		c, err := Dial(`127.0.0.1:` + strconv.Itoa(port))
+		Expect(err).To(Succeed())
+		defer c.ws.Close()
+		Expect(c.Send([]byte(`{ "cid": 1, "cmds":[{ "name" : "Subscribe", "data" : { "topic" : "news" } }]}`))).To(Succeed())
+		Expect(c.Await()).To(MatchJSON(`{ "cid": 1, "cmds":[{ "name" : "Subscribed", "data" : { "topic" : "news" } }]}`))
+		Expect(pubsub.Publish(`news`, StillAlive{Ping: `published`})).To(Equal(1))
+		Expect(server.BroadcastAll(StillAlive{Ping: `broadcast`})).To(Succeed())
+		Expect(logger.pushes).To(Receive(Equal(`published`)))
+		Expect(logger.pushes).To(Receive(Equal(`broadcast`)))
+	})
+})
+
+type pushLogger struct {
+	pushes chan string
+}
+
+func (pushLogger) LogRequest(session interface{}, in *apiserver.PacketIn, out *apiserver.PacketOut) {}
+
+func (self *pushLogger) LogPush(session interface{}, out *apiserver.PacketOut) {
+	self.pushes <- out.Commands[0].Data.(StillAlive).Ping
+}
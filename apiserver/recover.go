@@ -0,0 +1,53 @@
+package apiserver
+
+import (
+	"runtime/debug"
+)
+
+// PanicHandler receives value recovered while processing command and stack of the panicked goroutine
+type PanicHandler func(conn Conn, command string, recovered interface{}, stack []byte)
+
+// SetPanicHandler sets hook called when handler panics or its reply cannot be marshalled,
+// the command itself is answered with internal_error
+func (self *Router) SetPanicHandler(fn PanicHandler) {
+	self.panicHandler = fn
+}
+
+func (self *Router) internalError(conn Conn, command string, recovered interface{}, stack []byte) *ErrorCommand {
+	if self.panicHandler != nil {
+		self.panicHandler(conn, command, recovered, stack)
+	}
+	return ApiError(`internal_error`, `internal error`)
+}
+
+// marshalReply replaces commands which cannot be marshalled with internal_error, others are sent as is
+func (self *Router) marshalReply(conn Conn, out *PacketOut) []byte {
+	codec := conn.codec()
+	if buf, failure, _ := tryMarshal(codec, out); failure == nil {
+		return buf
+	}
+	commands := make([]CommandOut, 0, len(out.Commands))
+	for _, cmd := range out.Commands {
+		if _, failure, stack := tryMarshal(codec, &PacketOut{Commands: []CommandOut{cmd}}); failure != nil {
+			commands = append(commands, commandsOut(self.internalError(conn, cmd.Name, failure, stack))...)
+		} else {
+			commands = append(commands, cmd)
+		}
+	}
+	out.Commands = commands
+	return marshallPacket(codec, *out)
+}
+
+// tryMarshal returns error or value of panic raised by codec with stack where it happened
+func tryMarshal(codec Codec, packet *PacketOut) (buf []byte, failure interface{}, stack []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			failure, stack = r, debug.Stack()
+		}
+	}()
+	buf, err := codec.EncodePacket(packet)
+	if err != nil {
+		return nil, err, debug.Stack()
+	}
+	return buf, nil, nil
+}
@@ -0,0 +1,115 @@
+package apiserver
+
+import "sync"
+
+// registry keeps live connections by id
+type registry struct {
+	mu     sync.RWMutex
+	lastID uint64
+	conns  map[uint64]*Connection
+}
+
+func newRegistry() *registry {
+	return &registry{
+		conns: make(map[uint64]*Connection),
+	}
+}
+
+func (self *registry) add(conn *Connection) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.lastID++
+	conn.id = self.lastID
+	self.conns[conn.id] = conn
+}
+
+func (self *registry) remove(conn *Connection) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.conns[conn.id] == conn {
+		delete(self.conns, conn.id)
+	}
+}
+
+func (self *registry) get(id uint64) (*Connection, bool) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	conn, ok := self.conns[id]
+	return conn, ok
+}
+
+func (self *registry) count() int {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return len(self.conns)
+}
+
+// snapshot is used to iterate without holding the lock, so callbacks may close connections
+func (self *registry) snapshot() []*Connection {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	conns := make([]*Connection, 0, len(self.conns))
+	for _, conn := range self.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// Count returns number of live connections
+func (self *Server) Count() int {
+	return self.conns.count()
+}
+
+// Get returns live connection by its id
+func (self *Server) Get(id uint64) (Conn, bool) {
+	conn, ok := self.conns.get(id)
+	if !ok {
+		return nil, false
+	}
+	return conn, true
+}
+
+// Range calls fn for every live connection until fn returns false
+func (self *Server) Range(fn func(conn Conn) bool) {
+	for _, conn := range self.conns.snapshot() {
+		if !fn(conn) {
+			return
+		}
+	}
+}
+
+// Broadcast sends cmds to every live connection of this node accepted by filter,
+// or to all of them if filter is nil. It returns number of connections cmds were queued to.
+func (self *Server) Broadcast(filter func(conn Conn) bool, cmds ...CmdNamer) int {
+	sent := 0
+	self.Range(func(conn Conn) bool {
+		if filter != nil && !filter(conn) {
+			return true
+		}
+		if err := conn.Send(cmds...); err != nil {
+			self.log.Println(`broadcast to`, conn.ID(), `failed:`, err)
+		} else {
+			sent++
+		}
+		return true
+	})
+	return sent
+}
+
+// BroadcastAll sends cmds to every live connection, on all nodes if Broker is set
+func (self *Server) BroadcastAll(cmds ...CmdNamer) error {
+	packet := newEncodedPacket(pushPacket(cmds...))
+	self.deliverBroadcast(packet)
+	if self.broker != nil {
+		return self.broker.Publish(broadcastChannel, encodeBrokerMessage(self.origin, packet))
+	}
+	return nil
+}
+
+func (self *Server) deliverBroadcast(packet *encodedPacket) {
+	for _, conn := range self.conns.snapshot() {
+		if err := conn.sendPush(packet); err != nil {
+			self.log.Println(`broadcast to`, conn.ID(), `failed:`, err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package apiserver_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/x12tech/go-websocketapi/apiserver"
+)
+
+type orgSession struct {
+	org string
+}
+
+type loginRequest struct {
+	Org string `json:"org"`
+}
+
+type loginResponce struct {
+	ID uint64 `json:"id"`
+}
+
+func (loginResponce) CmdName() string {
+	return `login_responce`
+}
+
+var _ = Describe("registry", func() {
+	var (
+		server     *apiserver.Server
+		httpserver *http.Server
+		port       int
+	)
+	BeforeEach(func() {
+		router := apiserver.NewRouter()
+		router.RegisterApiHandler(0, `login`, func(conn apiserver.Conn, req *loginRequest) (*loginResponce, error) {
+			conn.Session().(*orgSession).org = req.Org
+			return &loginResponce{ID: conn.ID()}, nil
+		})
+		server, httpserver, port = startServer(apiserver.ServerOpts{
+			Router: router,
+			NewSessionFn: func() interface{} {
+				return new(orgSession)
+			},
+		})
+	})
+	AfterEach(func() {
+		httpserver.Shutdown(context.Background())
+	})
+	var Login = func(org string) (*ApiClient, uint64) {
+		c, err := Dial(`127.0.0.1:` + strconv.Itoa(port))
+		Expect(err).To(Succeed())
+		Expect(c.Send([]byte(`{ "cid": 1, "cmds":[{  "name" : "login", "data" : {"org" : "` + org + `"} }]}`))).To(Succeed())
+		buf, err := c.Await()
+		Expect(err).To(Succeed())
+		var packet struct {
+			Commands []struct {
+				Data loginResponce `json:"data"`
+			} `json:"cmds"`
+		}
+		Expect(json.Unmarshal(buf, &packet)).To(Succeed())
+		Expect(packet.Commands).To(HaveLen(1))
+		return c, packet.Commands[0].Data.ID
+	}
+	It(`tracks live connections`, func() {
+		c1, id1 := Login(`x`)
+		c2, id2 := Login(`y`)
+		Expect(id1).ToNot(Equal(id2))
+		Expect(server.Count()).To(Equal(2))
+		conn, ok := server.Get(id2)
+		Expect(ok).To(BeTrue())
+		Expect(conn.Session()).To(Equal(&orgSession{org: `y`}))
+
+		ids := make([]uint64, 0)
+		server.Range(func(conn apiserver.Conn) bool {
+			ids = append(ids, conn.ID())
+			return true
+		})
+		Expect(ids).To(ConsistOf(id1, id2))
+
+		Expect(c2.ws.Close()).To(Succeed())
+		Eventually(server.Count).Should(Equal(1))
+		_, ok = server.Get(id2)
+		Expect(ok).To(BeFalse())
+		Expect(c1.ws.Close()).To(Succeed())
+		Eventually(server.Count).Should(Equal(0))
+	})
+	It(`broadcasts to filtered connections`, func() {
+		c1, _ := Login(`x`)
+		c2, _ := Login(`y`)
+		c3, _ := Login(`x`)
+		sent := server.Broadcast(func(conn apiserver.Conn) bool {
+			return conn.Session().(*orgSession).org == `x`
+		}, StillAlive{Ping: `org x`})
+		Expect(sent).To(Equal(2))
+		Expect(c1.Await()).To(MatchJSON(`{ "cmds": [{  "name" : "StillAlive", "data":{"ping":"org x"} }]}`))
+		Expect(c3.Await()).To(MatchJSON(`{ "cmds": [{  "name" : "StillAlive", "data":{"ping":"org x"} }]}`))
+
+		// c2 gets nothing but the second broadcast
+		Expect(server.Broadcast(nil, StillAlive{Ping: `all`})).To(Equal(3))
+		Expect(c2.Await()).To(MatchJSON(`{ "cmds": [{  "name" : "StillAlive", "data":{"ping":"all"} }]}`))
+		for _, c := range []*ApiClient{c1, c2, c3} {
+			c.ws.Close()
+		}
+	})
+})
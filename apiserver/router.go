@@ -1,9 +1,11 @@
 package apiserver
 
 import (
-	"encoding/json"
+	"context"
 	"reflect"
+	"runtime/debug"
 	"sort"
+	"time"
 )
 
 type CmdNamer interface {
@@ -29,41 +31,78 @@ type Router struct {
 	commandHandlers map[string]*handlerValues
 	getVersion      func(conn Conn) int
 	cmdLogger       CmdLogger
+	commandTimeout  time.Duration
+	versions        *versionRange
+	panicHandler    PanicHandler
+	// strict decoding is applied since strictFromVersion
+	strict            bool
+	strictFromVersion int
 }
 
 func NewRouter() *Router {
 	return &Router{
 		commandHandlers: make(map[string]*handlerValues),
-		getVersion:      func(conn Conn) int { return 0 },
+		getVersion:      func(conn Conn) int { return conn.Version() },
 	}
 }
 func (self *Router) SetCmdLogger(l CmdLogger) {
 	self.cmdLogger = l
 }
 
+// SetCommandTimeout answers commands running longer than d with timeout error and cancels their context,
+// no timeout if zero. It may be overridden per handler with WithTimeout.
+func (self *Router) SetCommandTimeout(d time.Duration) {
+	self.commandTimeout = d
+}
+
 // handlerFunc Must be func(*Conn,*SomeType) *SomeRetType,error
 // Or func(*Conn,*SomeType) *SomeRetType,*SomeOtherRetType,error
 // Or func(*Conn,*SomeType) []interface{},error
 // Or func(*Conn,*SomeType) error
+// Each of them may take context.Context as the first argument,
+// it is cancelled when connection is closed or command timeout expires
 func (self *Router) RegisterApiHandler(version int, command string, handler handlerFunc) {
-	handlers := self.commandHandlers[command]
-	if handlers == nil {
-		handlers = new(handlerValues)
-		self.commandHandlers[command] = handlers
-	}
-	*handlers = append(*handlers, handlerValue{version, NewHandler(handler, nil)})
-	sort.Sort(*handlers)
+	self.registerHandler(version, command, newHandler(handler, nil))
 }
 
 type MiddlewareFunc func(conn Conn) (commands []CmdNamer, next bool)
 
+// ContextMiddlewareFunc may return ctx enriched with request scoped values, it is passed to the next middleware and handler
+type ContextMiddlewareFunc func(ctx context.Context, conn Conn) (newCtx context.Context, commands []CmdNamer, next bool)
+
+func (self MiddlewareFunc) withContext() ContextMiddlewareFunc {
+	return func(ctx context.Context, conn Conn) (context.Context, []CmdNamer, bool) {
+		commands, next := self(conn)
+		return ctx, commands, next
+	}
+}
+
+func contextMiddlewares(middle []MiddlewareFunc) []ContextMiddlewareFunc {
+	if middle == nil {
+		return nil
+	}
+	out := make([]ContextMiddlewareFunc, 0, len(middle))
+	for _, mw := range middle {
+		out = append(out, mw.withContext())
+	}
+	return out
+}
+
 func (self *Router) RegisterApiHandlerWithMiddleware(version int, command string, handler handlerFunc, middle []MiddlewareFunc) {
+	self.registerHandler(version, command, newHandler(handler, contextMiddlewares(middle)))
+}
+
+func (self *Router) RegisterApiHandlerWithContextMiddleware(version int, command string, handler handlerFunc, middle []ContextMiddlewareFunc) {
+	self.registerHandler(version, command, newHandler(handler, middle))
+}
+
+func (self *Router) registerHandler(version int, command string, h *handler) {
 	handlers := self.commandHandlers[command]
 	if handlers == nil {
 		handlers = new(handlerValues)
 		self.commandHandlers[command] = handlers
 	}
-	*handlers = append(*handlers, handlerValue{version, NewHandler(handler, middle)})
+	*handlers = append(*handlers, handlerValue{version, h})
 	sort.Sort(*handlers)
 }
 
@@ -72,46 +111,63 @@ func (self *Router) RegisterGetVersion(cb func(conn Conn) int) {
 }
 
 func (self *Router) With(mw MiddlewareFunc) *middlewareWrapper {
+	return self.WithContext(mw.withContext())
+}
+
+func (self *Router) WithContext(mw ContextMiddlewareFunc) *middlewareWrapper {
 	return &middlewareWrapper{
-		funcs:  []MiddlewareFunc{mw},
+		funcs:  []ContextMiddlewareFunc{mw},
 		router: self,
 	}
 }
 
 type middlewareWrapper struct {
-	funcs  []MiddlewareFunc
-	router *Router
+	funcs   []ContextMiddlewareFunc
+	router  *Router
+	timeout time.Duration
 }
 
 func (self *middlewareWrapper) With(mw MiddlewareFunc) *middlewareWrapper {
+	return self.WithContext(mw.withContext())
+}
+
+func (self *middlewareWrapper) WithContext(mw ContextMiddlewareFunc) *middlewareWrapper {
 	return &middlewareWrapper{
-		funcs:  append(self.funcs, mw),
-		router: self.router,
+		funcs:   append(self.funcs, mw),
+		router:  self.router,
+		timeout: self.timeout,
 	}
 }
 
 func (self *middlewareWrapper) RegisterApiHandler(version int, command string, handler handlerFunc) {
-	self.router.RegisterApiHandlerWithMiddleware(version, command, handler, self.funcs)
+	self.registerHandler(version, command, newHandler(handler, nil))
+}
+
+func (self *middlewareWrapper) registerHandler(version int, command string, h *handler) {
+	h.Middleware = self.funcs
+	h.Timeout = self.timeout
+	self.router.registerHandler(version, command, h)
 }
 
-func (self *Router) ProcessCommand(conn Conn, version int, command string, data json.RawMessage) (res []CommandOut) {
+func (self *Router) ProcessCommand(conn Conn, version int, command string, data []byte) (res []CommandOut) {
+	defer func() {
+		if r := recover(); r != nil {
+			res = commandsOut(self.internalError(conn, command, r, debug.Stack()))
+		}
+	}()
 	if handlers, ok := self.commandHandlers[command]; ok {
 		found := false
 		for _, handler := range *handlers {
-			if handler.Version <= self.getVersion(conn) {
-				cmds, err := handler.Handler.Call(conn, data)
-				res = make([]CommandOut, 0, len(cmds))
+			if handler.Version <= version {
+				ctx := conn.Context()
+				if self.strictDecoding(version) {
+					ctx = withStrictDecoding(ctx)
+				}
+				cmds, err := self.call(ctx, handler.Handler, conn, command, data)
 				if err != nil {
 					res = apiErrorCommands(`exec_error`, err.Error())
 				} else {
-					for _, cmd := range cmds {
-						if cmd != nil {
-							res = append(res, CommandOut{
-								Name: cmd.CmdName(),
-								Data: cmd,
-							})
-						}
-					}
+					res = commandsOut(cmds...)
 				}
 				found = true
 				break
@@ -126,41 +182,80 @@ func (self *Router) ProcessCommand(conn Conn, version int, command string, data
 	return
 }
 
+func commandsOut(cmds ...CmdNamer) []CommandOut {
+	res := make([]CommandOut, 0, len(cmds))
+	for _, cmd := range cmds {
+		if cmd != nil {
+			res = append(res, CommandOut{
+				Name: cmd.CmdName(),
+				Data: cmd,
+			})
+		}
+	}
+	return res
+}
+
 func (self *Router) ProcessPacket(conn Conn, packetBuf []byte) {
-	var packet *PacketIn
-	err := json.Unmarshal(packetBuf, &packet)
+	conn.send(self.handlePacket(conn, packetBuf))
+}
+
+// handlePacket returns reply instead of sending it, so caller decides when it is sent
+func (self *Router) handlePacket(conn Conn, packetBuf []byte) []byte {
+	packet, out, err := self.runPacket(conn, packetBuf)
 	if err != nil {
-		errBuf, _ := json.Marshal(&PacketOut{
-			Commands: apiErrorCommands("cannot parse command", err.Error()),
-		})
-		conn.send(errBuf)
-		return
+		return parseErrorPacket(conn.codec(), err)
+	}
+	ret := self.marshalReply(conn, out)
+	if self.cmdLogger != nil {
+		self.cmdLogger.LogRequest(conn.Session(), packet, out)
 	}
+	return ret
+}
+
+// runPacket processes commands of packet, err is set only if packet cannot be decoded
+func (self *Router) runPacket(conn Conn, packetBuf []byte) (*PacketIn, *PacketOut, error) {
+	packet, err := conn.codec().DecodePacket(packetBuf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return packet, self.runCommands(conn, packet), nil
+}
+
+func (self *Router) runCommands(conn Conn, packet *PacketIn) *PacketOut {
 	out := &PacketOut{
 		Cid: packet.Cid,
 	}
 	for _, cmd := range packet.Commands {
-		res := self.ProcessCommand(conn, 0, cmd.Name, cmd.Data)
+		// version is read for every command as Hello may change it
+		res := self.ProcessCommand(conn, self.getVersion(conn), cmd.Name, cmd.Data)
 		out.Commands = append(out.Commands, res...)
 	}
-	if self.cmdLogger != nil {
-		self.cmdLogger.LogRequest(conn.Session(), packet, out)
+	return out
+}
+
+func parseErrorPacket(codec Codec, err error) []byte {
+	return marshallPacket(codec, PacketOut{
+		Commands: apiErrorCommands("cannot parse command", err.Error()),
+	})
+}
+
+func pushPacket(cmds ...CmdNamer) PacketOut {
+	packet := PacketOut{
+		Commands: make([]CommandOut, 0, len(cmds)),
 	}
-	ret, err := json.Marshal(out)
-	if err != nil {
-		panic(err)
-	} else {
-		conn.send(ret)
+	for _, cmd := range cmds {
+		packet.Commands = append(packet.Commands, CommandOut{Name: cmd.CmdName(), Data: cmd})
 	}
+	return packet
 }
 
-func marshallPacket(packet PacketOut) []byte {
-	buf, err := json.Marshal(packet)
+func marshallPacket(codec Codec, packet PacketOut) []byte {
+	buf, err := codec.EncodePacket(&packet)
 	if err != nil {
 		errPacket := PacketOut{
 			Commands: apiErrorCommands(`internal_error`, err.Error()),
 		}
-		buf, _ = json.Marshal(errPacket)
+		buf, _ = codec.EncodePacket(&errPacket)
 	}
 	return buf
 }
@@ -169,6 +264,8 @@ type ServerCommandDesciption struct {
 	Name           string
 	ReplayCommands []string
 	Params         interface{}
+	// Constraints are validate rules of params by field path, nil if there are none
+	Constraints map[string]string
 }
 
 type ClientCommandDesciption struct {
@@ -196,6 +293,7 @@ func (self *Router) DescribeApi(tm map[reflect.Type]string) (scmds []*ServerComm
 			Name:           name,
 			ReplayCommands: replay,
 			Params:         describer.Describe(handler.Input),
+			Constraints:    describer.Constraints(handler.Input),
 		}
 	}
 	serverCommandsSlice := make([]string, 0, len(serverCommands))
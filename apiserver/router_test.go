@@ -9,6 +9,7 @@ import (
 	"context"
 
 	"strconv"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -169,6 +170,77 @@ var _ = Describe("main", func() {
 		`))
 		Expect(c.Await()).To(MatchJSON(`{ "cid" : 123, "cmds": [{  "name" : "Error", "data" : { "type" : "errtype", "msg" : "descr"} }]}`))
 	})
+	It(`enriches context in middleware`, func() {
+		type userKey struct{}
+		router.WithContext(func(ctx context.Context, conn apiserver.Conn) (context.Context, []apiserver.CmdNamer, bool) {
+			return context.WithValue(ctx, userKey{}, `user1`), nil, true
+		}).RegisterApiHandler(0, `cmdname`, func(ctx context.Context, conn apiserver.Conn) (*testEchoResponce, error) {
+			return &testEchoResponce{Pong: ctx.Value(userKey{}).(string)}, nil
+		})
+		c := Connect()
+		c.Send([]byte(`
+			{ "cid": 123, "cmds":[{  "name" : "cmdname" }]}
+		`))
+		Expect(c.Await()).To(MatchJSON(
+			`{ "cid" : 123, "cmds": [{ "name": "test_echo_responce", "data" : { "pong" : "user1" }  }]}
+		`))
+	})
+	It(`replies timeout and cancels context on command timeout`, func() {
+		logger := &lateLogger{results: make(chan string, 1)}
+		router.SetCmdLogger(logger)
+		router.SetCommandTimeout(10 * time.Millisecond)
+		router.RegisterApiHandler(0, `cmdname`, func(ctx context.Context, conn apiserver.Conn) (*testEchoResponce, error) {
+			<-ctx.Done()
+			return &testEchoResponce{Pong: ctx.Err().Error()}, nil
+		})
+		c := Connect()
+		c.Send([]byte(`
+			{ "cid": 123, "cmds":[{  "name" : "cmdname" }]}
+		`))
+		Expect(c.Await()).To(MatchJSON(
+			`{ "cid" : 123, "cmds": [{ "name": "Error", "data" : { "type" : "timeout", "msg" : "command timed out after 10ms" }  }]}
+		`))
+		Eventually(logger.results).Should(Receive(Equal(`cmdname: context deadline exceeded`)))
+	})
+	It(`overrides command timeout per handler`, func() {
+		router.SetCommandTimeout(10 * time.Millisecond)
+		router.WithTimeout(time.Second).RegisterApiHandler(0, `slow`, func(conn apiserver.Conn) (*testEchoResponce, error) {
+			time.Sleep(30 * time.Millisecond)
+			return &testEchoResponce{Pong: `slow`}, nil
+		})
+		router.With(func(conn apiserver.Conn) ([]apiserver.CmdNamer, bool) {
+			return nil, true
+		}).WithTimeout(time.Millisecond).RegisterApiHandler(0, `cmdname`, func(conn apiserver.Conn) (*testEchoResponce, error) {
+			time.Sleep(30 * time.Millisecond)
+			return &testEchoResponce{Pong: `late`}, nil
+		})
+		c := Connect()
+		c.Send([]byte(`
+			{ "cid": 123, "cmds":[{  "name" : "slow" }, {  "name" : "cmdname" }]}
+		`))
+		Expect(c.Await()).To(MatchJSON(`{ "cid" : 123, "cmds": [
+			{ "name": "test_echo_responce", "data" : { "pong" : "slow" } },
+			{ "name": "Error", "data" : { "type" : "timeout", "msg" : "command timed out after 1ms" } }
+		]}`))
+	})
+	It(`cancels context when connection is closed`, func() {
+		cancelled := make(chan struct{})
+		router.RegisterApiHandler(0, `cmdname`, func(ctx context.Context, conn apiserver.Conn) error {
+			go func() {
+				<-ctx.Done()
+				close(cancelled)
+			}()
+			return nil
+		})
+		c := Connect()
+		c.Send([]byte(`
+			{ "cid": 123, "cmds":[{  "name" : "cmdname" }]}
+		`))
+		Expect(c.Await()).To(MatchJSON(`{ "cid" : 123, "cmds": null}`))
+		Consistently(cancelled, 20*time.Millisecond).ShouldNot(BeClosed())
+		Expect(c.ws.Close()).To(Succeed())
+		Eventually(cancelled).Should(BeClosed())
+	})
 	It(`handles apierror`, func() {
 		router.RegisterApiHandler(0, `cmdname`, func(conn apiserver.Conn) error {
 			return apiserver.ApiError(`errtype`, `descr`)
@@ -189,8 +261,75 @@ var _ = Describe("main", func() {
 		`))
 		Expect(c.Await()).To(MatchJSON(`{ "cid" : 123, "cmds": [{  "name" : "Error", "data" : { "type" : "errtype", "msg" : "descr"} }]}`))
 	})
+	It(`recovers handler panic`, func() {
+		panics := make(chan string, 1)
+		stacks := make(chan string, 1)
+		router.SetPanicHandler(func(conn apiserver.Conn, command string, recovered interface{}, stack []byte) {
+			panics <- command + `: ` + recovered.(string)
+			stacks <- string(stack)
+		})
+		router.RegisterApiHandler(0, `broken`, func(conn apiserver.Conn) error {
+			panic(`broken handler`)
+		})
+		router.RegisterApiHandler(0, `cmdname`, func(conn apiserver.Conn, req *testEchoRequest) (*testEchoResponce, error) {
+			return &testEchoResponce{Pong: req.Ping}, nil
+		})
+		c := Connect()
+		c.Send([]byte(`
+			{ "cid": 123, "cmds":[{  "name" : "broken" }, {  "name" : "cmdname", "data" : { "ping" : "alive" } }]}
+		`))
+		Expect(c.Await()).To(MatchJSON(`{ "cid" : 123, "cmds": [
+			{ "name" : "Error", "data" : { "type" : "internal_error", "msg" : "internal error"} },
+			{ "name": "test_echo_responce", "data" : { "pong" : "alive" } }
+		]}`))
+		Expect(panics).To(Receive(Equal(`broken: broken handler`)))
+		Expect(stacks).To(Receive(ContainSubstring(`router_test.go`)))
+	})
+	It(`replaces reply which cannot be marshalled`, func() {
+		panics := make(chan string, 1)
+		router.SetPanicHandler(func(conn apiserver.Conn, command string, recovered interface{}, stack []byte) {
+			panics <- command
+		})
+		router.RegisterApiHandler(0, `broken`, func(conn apiserver.Conn) (*unmarshallable, error) {
+			return &unmarshallable{}, nil
+		})
+		router.RegisterApiHandler(0, `cmdname`, func(conn apiserver.Conn, req *testEchoRequest) (*testEchoResponce, error) {
+			return &testEchoResponce{Pong: req.Ping}, nil
+		})
+		c := Connect()
+		c.Send([]byte(`
+			{ "cid": 123, "cmds":[{  "name" : "cmdname", "data" : { "ping" : "alive" } }, {  "name" : "broken" }]}
+		`))
+		Expect(c.Await()).To(MatchJSON(`{ "cid" : 123, "cmds": [
+			{ "name": "test_echo_responce", "data" : { "pong" : "alive" } },
+			{ "name" : "Error", "data" : { "type" : "internal_error", "msg" : "internal error"} }
+		]}`))
+		Expect(panics).To(Receive(Equal(`unmarshallable`)))
+	})
 })
 
+type lateLogger struct {
+	results chan string
+}
+
+func (lateLogger) LogRequest(session interface{}, in *apiserver.PacketIn, out *apiserver.PacketOut) {}
+
+func (lateLogger) LogPush(session interface{}, out *apiserver.PacketOut) {}
+
+func (self *lateLogger) LogLateResult(session interface{}, command string, out []apiserver.CmdNamer, err error) {
+	self.results <- command + `: ` + out[0].(*testEchoResponce).Pong
+}
+
+type unmarshallable struct{}
+
+func (unmarshallable) CmdName() string {
+	return `unmarshallable`
+}
+
+func (unmarshallable) MarshalJSON() ([]byte, error) {
+	panic(`cannot marshal`)
+}
+
 type ApiClient struct {
 	ws *websocket.Conn
 }
@@ -216,9 +355,9 @@ func Upgrade(url, rwc io.ReadWriteCloser) (*ApiClient, error) {
 }
 
 func (cli *ApiClient) Await() ([]byte, error) {
-	buf := make([]byte, 65536)
-	n, err := cli.ws.Read(buf)
-	return buf[:n], err
+	var buf []byte
+	err := websocket.Message.Receive(cli.ws, &buf)
+	return buf, err
 }
 
 func (cli *ApiClient) Send(buf []byte) error {
@@ -1,7 +1,12 @@
 package apiserver
 
 import (
+	"compress/flate"
+	"context"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/net/websocket"
@@ -22,10 +27,29 @@ func (EmptyLogger) Println(v ...interface{}) {}
 
 type Server struct {
 	router         *Router
-	wsServer       *websocket.Server
+	upgrader       Upgrader
+	transportOpts  TransportOpts
 	newSessionFunc func() interface{}
 	log            Logger
 	cmdLogger      CmdLogger
+	connOpts       connOpts
+	shutdownCmd    CmdNamer
+	codecs         []Codec
+	pubsub         *PubSub
+	broker         Broker
+	cancelBroker   func()
+	origin         string
+	commandTimeout time.Duration
+	mu             sync.Mutex
+	conns          *registry
+	shuttingDown   bool
+	inflight       sync.WaitGroup
+	// fallbacks is nil unless fallback transport is enabled
+	fallbacks      *fallbacks
+	pollTimeout    time.Duration
+	abandonTimeout time.Duration
+	// listeners are closed on Shutdown
+	listeners map[net.Listener]struct{}
 }
 
 type ServerOpts struct {
@@ -33,8 +57,66 @@ type ServerOpts struct {
 	NewSessionFn func() interface{}
 	Logger       Logger
 	CmdLogger    CmdLogger
+	// MaxMessageSize limits incoming message size in bytes, websocket.DefaultMaxPayloadBytes if zero
+	MaxMessageSize int
+	// SendQueueSize is a number of outgoing packets buffered per connection, DefaultSendQueueSize if zero
+	SendQueueSize int
+	// SendQueuePolicy is applied when send queue is full
+	SendQueuePolicy OverflowPolicy
+	// WriteTimeout limits a single packet write, DefaultWriteTimeout if zero
+	WriteTimeout time.Duration
+	// PingInterval enables websocket pings when not zero
+	PingInterval time.Duration
+	// PongTimeout closes connection if peer sends nothing back in time after ping, PingInterval if zero
+	PongTimeout time.Duration
+	// IdleTimeout closes connection which sends no messages for that long, disabled if zero
+	IdleTimeout time.Duration
+	// ShutdownCmd is pushed to every connection on Shutdown if not nil
+	ShutdownCmd CmdNamer
+	// PubSub subscriptions are dropped when connection is closed
+	PubSub *PubSub
+	// Broker makes BroadcastAll reach connections of every node sharing it
+	Broker Broker
+	// DispatchMode allows to process packets of a connection concurrently, DispatchSequential by default
+	DispatchMode DispatchMode
+	// MaxConcurrentPackets limits packets processed at once per connection in concurrent modes,
+	// DefaultMaxConcurrentPackets if zero
+	MaxConcurrentPackets int
+	// CommandTimeout overrides Router command timeout for connections of this server when not zero,
+	// see Router.SetCommandTimeout
+	CommandTimeout time.Duration
+	// Codecs are chosen by websocket subprotocol, DefaultCodecs if empty.
+	// JSONCodec is used when client offers no known subprotocol.
+	Codecs []Codec
+	// Upgrader accepts websocket connections with NewXNetUpgrader, NewGorillaUpgrader or NewCoderUpgrader.
+	// NewXNetUpgrader is used if nil, or NewGorillaUpgrader if compression is enabled.
+	Upgrader Upgrader
+	// EnableCompression negotiates permessage-deflate with clients offering it
+	EnableCompression bool
+	// CompressionLevel is a compress/flate level from flate.HuffmanOnly to flate.BestCompression,
+	// flate.DefaultCompression if zero. NewCoderUpgrader does not support it.
+	CompressionLevel int
+	// CompressionThreshold is the least packet size in bytes to be compressed, DefaultCompressionThreshold if zero
+	CompressionThreshold int
+	// EnableFallback serves requests which are not websocket upgrades with Server-Sent Events
+	// or long-poll fallback transport, see fallback.go
+	EnableFallback bool
+	// PollTimeout limits how long a poll request waits for packets, DefaultPollTimeout if zero
+	PollTimeout time.Duration
+	// FallbackReconnectTimeout closes fallback connection when client neither streams nor polls for that long,
+	// DefaultFallbackReconnectTimeout if zero
+	FallbackReconnectTimeout time.Duration
 }
 
+const (
+	DefaultSendQueueSize = 64
+	DefaultWriteTimeout  = 10 * time.Second
+	// DefaultMaxConcurrentPackets is used by concurrent dispatch modes
+	DefaultMaxConcurrentPackets = 16
+	// DefaultCompressionThreshold leaves small packets uncompressed, as deflate hardly pays off on them
+	DefaultCompressionThreshold = 512
+)
+
 func NewServer(opts ServerOpts) (*Server, error) {
 	if opts.Router == nil {
 		return nil, errors.New(`router not defined`)
@@ -47,35 +129,237 @@ func NewServer(opts ServerOpts) (*Server, error) {
 	if opts.Logger == nil {
 		opts.Logger = &EmptyLogger{}
 	}
+	if opts.MaxMessageSize <= 0 {
+		opts.MaxMessageSize = websocket.DefaultMaxPayloadBytes
+	}
+	if opts.SendQueueSize <= 0 {
+		opts.SendQueueSize = DefaultSendQueueSize
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = DefaultWriteTimeout
+	}
+	if opts.PongTimeout <= 0 {
+		opts.PongTimeout = opts.PingInterval
+	}
+	if len(opts.Codecs) == 0 {
+		opts.Codecs = DefaultCodecs
+	}
+	if opts.MaxConcurrentPackets <= 0 {
+		opts.MaxConcurrentPackets = DefaultMaxConcurrentPackets
+	}
+	if opts.EnableCompression {
+		if opts.Upgrader == nil {
+			opts.Upgrader = NewGorillaUpgrader()
+		}
+		if _, ok := opts.Upgrader.(xnetUpgrader); ok {
+			return nil, errors.New(`x/net upgrader does not support compression`)
+		}
+		if _, ok := opts.Upgrader.(coderUpgrader); ok && opts.CompressionLevel != 0 {
+			return nil, errors.New(`coder upgrader does not support compression level`)
+		}
+		if opts.CompressionLevel == 0 {
+			opts.CompressionLevel = flate.DefaultCompression
+		}
+		if opts.CompressionLevel < flate.HuffmanOnly || opts.CompressionLevel > flate.BestCompression {
+			return nil, errors.Errorf(`invalid compression level %d`, opts.CompressionLevel)
+		}
+		if opts.CompressionThreshold <= 0 {
+			opts.CompressionThreshold = DefaultCompressionThreshold
+		}
+	}
+	if opts.Upgrader == nil {
+		opts.Upgrader = NewXNetUpgrader()
+	}
+	if opts.PollTimeout <= 0 {
+		opts.PollTimeout = DefaultPollTimeout
+	}
+	if opts.FallbackReconnectTimeout <= 0 {
+		opts.FallbackReconnectTimeout = DefaultFallbackReconnectTimeout
+	}
 	self := &Server{
 		router:         opts.Router,
 		newSessionFunc: opts.NewSessionFn,
 		log:            opts.Logger,
 		cmdLogger:      opts.CmdLogger,
+		connOpts: connOpts{
+			maxMessageSize:       opts.MaxMessageSize,
+			sendQueueSize:        opts.SendQueueSize,
+			overflowPolicy:       opts.SendQueuePolicy,
+			writeTimeout:         opts.WriteTimeout,
+			pingInterval:         opts.PingInterval,
+			pongTimeout:          opts.PongTimeout,
+			idleTimeout:          opts.IdleTimeout,
+			dispatchMode:         opts.DispatchMode,
+			maxConcurrentPackets: opts.MaxConcurrentPackets,
+		},
+		upgrader: opts.Upgrader,
+		transportOpts: TransportOpts{
+			MaxMessageSize:       opts.MaxMessageSize,
+			Compression:          opts.EnableCompression,
+			CompressionLevel:     opts.CompressionLevel,
+			CompressionThreshold: opts.CompressionThreshold,
+			PongTimeout:          opts.PongTimeout,
+		},
+		shutdownCmd:    opts.ShutdownCmd,
+		codecs:         opts.Codecs,
+		pubsub:         opts.PubSub,
+		broker:         opts.Broker,
+		conns:          newRegistry(),
+		origin:         newOrigin(),
+		commandTimeout: opts.CommandTimeout,
+		pollTimeout:    opts.PollTimeout,
+		abandonTimeout: opts.FallbackReconnectTimeout,
+	}
+	if opts.EnableFallback {
+		self.fallbacks = newFallbacks()
 	}
-	self.wsServer = &websocket.Server{
-		Handler: self.HandleWs,
+	if self.broker != nil {
+		cancel, err := self.broker.Subscribe(broadcastChannel, func(payload []byte) {
+			if packet := decodeBrokerMessage(self.origin, payload); packet != nil {
+				self.deliverBroadcast(packet)
+			}
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, `broker subscribe`)
+		}
+		self.cancelBroker = cancel
 	}
 	return self, nil
 }
 
 func (self *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	self.log.Println(`handle connect`)
-	self.wsServer.ServeHTTP(w, req)
+	if self.isShuttingDown() {
+		http.Error(w, `server is shutting down`, http.StatusServiceUnavailable)
+		return
+	}
+	if _, _, err := self.router.queryVersion(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if self.fallbacks != nil && !isWebsocketUpgrade(req) {
+		self.serveFallback(w, req)
+		return
+	}
+	// answer with subprotocol of the chosen codec, or with none if client offers no known one
+	subprotocol := ``
+	if codec, ok := codecOf(self.codecs, offeredSubprotocols(req)); ok {
+		subprotocol = codec.Subprotocol()
+	}
+	self.upgrader.Upgrade(w, req, subprotocol, self.transportOpts, self.serveTransport)
 }
 
+// HandleWs serves connection accepted by x/net/websocket server outside of ServeHTTP
 func (self *Server) HandleWs(ws *websocket.Conn) {
-	conn := &Connection{
-		ws:        ws,
-		onInput:   self.router.ProcessPacket,
-		onClose:   self.onConnectionClose,
-		log:       self.log,
-		cmdLogger: self.cmdLogger,
-		sess:      self.newSessionFunc(),
-	}
-	conn.Start()
+	self.serveTransport(newXNetTransport(ws, self.transportOpts))
+}
+
+func (self *Server) serveTransport(t Transport) {
+	if conn := self.accept(t); conn != nil {
+		conn.Start()
+	}
+}
+
+// accept registers connection over t, it returns nil and closes t when server is shutting down
+func (self *Server) accept(t Transport) *Connection {
+	conn := newConnection(t, self.connOpts)
+	conn.onInput = self.processPacket
+	conn.onClose = self.onConnectionClose
+	conn.log = self.log
+	conn.cmdLogger = self.cmdLogger
+	conn.sess = self.newSessionFunc()
+	if self.commandTimeout > 0 {
+		conn.ctx = withCommandTimeout(conn.ctx, self.commandTimeout)
+	}
+	if ct, ok := t.(codecTransport); ok {
+		conn.wireCodec = ct.wireCodec()
+	} else if codec, ok := codecOf(self.codecs, []string{t.Subprotocol()}); ok {
+		conn.wireCodec = codec
+	}
+	if req := t.Request(); req != nil {
+		if version, ok, _ := self.router.queryVersion(req); ok {
+			conn.SetVersion(version)
+		}
+	}
+	self.mu.Lock()
+	if self.shuttingDown {
+		self.mu.Unlock()
+		t.Close(CloseGoingAway, ErrServerShutdown.Error())
+		return nil
+	}
+	self.conns.add(conn)
+	self.mu.Unlock()
+	return conn
+}
+
+// processPacket keeps packet in flight until its reply is queued, so Shutdown sends it before closing
+func (self *Server) processPacket(conn Conn, buf []byte) ([]byte, func()) {
+	self.mu.Lock()
+	if self.shuttingDown {
+		self.mu.Unlock()
+		self.log.Println(`packet dropped on shutdown`)
+		return nil, func() {}
+	}
+	self.inflight.Add(1)
+	self.mu.Unlock()
+	return self.router.handlePacket(conn, buf), self.inflight.Done
 }
 
 func (self *Server) onConnectionClose(conn Conn) {
+	if c, ok := conn.(*Connection); ok {
+		self.conns.remove(c)
+	}
+	if self.pubsub != nil {
+		self.pubsub.UnsubscribeAll(conn)
+	}
+}
+
+func (self *Server) isShuttingDown() bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.shuttingDown
+}
+
+// Shutdown stops accepting connections and packets, waits for packets being processed,
+// pushes ShutdownCmd and closes every connection with going away code.
+// It returns when all session Close hooks are done or ctx is done.
+func (self *Server) Shutdown(ctx context.Context) error {
+	self.mu.Lock()
+	self.shuttingDown = true
+	self.mu.Unlock()
+	self.closeListeners()
+	if self.cancelBroker != nil {
+		self.cancelBroker()
+	}
+
+	if err := waitCtx(ctx, self.inflight.Wait); err != nil {
+		return err
+	}
+
+	var closing sync.WaitGroup
+	for _, conn := range self.conns.snapshot() {
+		if self.shutdownCmd != nil {
+			conn.Send(self.shutdownCmd)
+		}
+		closing.Add(1)
+		go func(conn *Connection) {
+			defer closing.Done()
+			conn.closeWithReason(ErrServerShutdown)
+		}(conn)
+	}
+	return waitCtx(ctx, closing.Wait)
+}
 
+func waitCtx(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -0,0 +1,346 @@
+package apiserver_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/x12tech/go-websocketapi/apiserver"
+)
+
+const (
+	testMaxMessageSize = 200 * 1024
+	sizedPacketPrefix  = `{ "cid": 123, "cmds":[{  "name" : "cmdname", "data" : {"ping" : "`
+	sizedPacketSuffix  = `"} }]}`
+)
+
+func packetOfSize(size int) []byte {
+	return []byte(sizedPacketPrefix + strings.Repeat(`x`, pingLenOfSize(size)) + sizedPacketSuffix)
+}
+
+func pingLenOfSize(size int) int {
+	return size - len(sizedPacketPrefix) - len(sizedPacketSuffix)
+}
+
+func startServer(opts apiserver.ServerOpts) (*apiserver.Server, *http.Server, int) {
+	server, err := apiserver.NewServer(opts)
+	Expect(err).To(Succeed())
+	listener, port, err := ListenSomeTcpPort()
+	Expect(err).To(Succeed())
+	httpserver := &http.Server{
+		Handler: server,
+	}
+	go httpserver.Serve(listener)
+	return server, httpserver, port
+}
+
+var _ = Describe("server", func() {
+	var (
+		router     *apiserver.Router
+		server     *apiserver.Server
+		httpserver *http.Server
+		err        error
+		port       int
+	)
+	BeforeEach(func() {
+		router = apiserver.NewRouter()
+		router.RegisterApiHandler(0, `cmdname`, func(conn apiserver.Conn, req *testEchoRequest) (*testEchoResponce, error) {
+			return &testEchoResponce{Pong: strconv.Itoa(len(req.Ping))}, nil
+		})
+		server, err = apiserver.NewServer(apiserver.ServerOpts{
+			Router:         router,
+			MaxMessageSize: testMaxMessageSize,
+		})
+		Expect(err).To(Succeed())
+		listener, p, err := ListenSomeTcpPort()
+		port = p
+		Expect(err).To(Succeed())
+
+		httpserver = &http.Server{
+			Handler: server,
+		}
+		go httpserver.Serve(listener)
+	})
+	AfterEach(func() {
+		httpserver.Shutdown(context.Background())
+	})
+	var Connect = func() *ApiClient {
+		conn, err := Dial(`127.0.0.1:` + strconv.Itoa(port))
+		Expect(err).To(Succeed())
+		return conn
+	}
+	It(`reads packet just under the limit as a whole`, func() {
+		c := Connect()
+		Expect(c.Send(packetOfSize(testMaxMessageSize - 1))).To(Succeed())
+		Expect(c.Await()).To(MatchJSON(`{ "cid" : 123, "cmds": [{ "name": "test_echo_responce", "data" : { "pong" : "` +
+			strconv.Itoa(pingLenOfSize(testMaxMessageSize-1)) + `" } }]}`))
+	})
+	It(`reads packet at the limit as a whole`, func() {
+		c := Connect()
+		Expect(c.Send(packetOfSize(testMaxMessageSize))).To(Succeed())
+		Expect(c.Await()).To(MatchJSON(`{ "cid" : 123, "cmds": [{ "name": "test_echo_responce", "data" : { "pong" : "` +
+			strconv.Itoa(pingLenOfSize(testMaxMessageSize)) + `" } }]}`))
+	})
+	It(`rejects packet over the limit and closes connection`, func() {
+		c := Connect()
+		Expect(c.Send(packetOfSize(testMaxMessageSize + 1))).To(Succeed())
+		Expect(c.Await()).To(MatchJSON(`{ "cmds": [{  "name" : "Error", "data" : { "type" : "message_too_large", "msg" : "message exceeds 204800 bytes"} }]}`))
+		_, err := c.Await()
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("send queue", func() {
+	var (
+		router     *apiserver.Router
+		httpserver *http.Server
+		port       int
+		conns      chan apiserver.Conn
+	)
+	BeforeEach(func() {
+		conns = make(chan apiserver.Conn, 1)
+		router = apiserver.NewRouter()
+		router.RegisterApiHandler(0, `start_pushes`, func(conn apiserver.Conn) error {
+			conns <- conn
+			return nil
+		})
+	})
+	AfterEach(func() {
+		httpserver.Shutdown(context.Background())
+	})
+	var Connect = func(opts apiserver.ServerOpts) (*ApiClient, apiserver.Conn) {
+		opts.Router = router
+		_, httpserver, port = startServer(opts)
+		c, err := Dial(`127.0.0.1:` + strconv.Itoa(port))
+		Expect(err).To(Succeed())
+		Expect(c.Send([]byte(`{ "cid": 1, "cmds":[{  "name" : "start_pushes" }]}`))).To(Succeed())
+		Expect(c.Await()).To(MatchJSON(`{ "cid" : 1, "cmds": null}`))
+		return c, <-conns
+	}
+	// client never reads, so pushes pile up in socket buffers and then in the queue
+	var pushUntilError = func(conn apiserver.Conn) error {
+		big := StillAlive{Ping: strings.Repeat(`x`, 256*1024)}
+		for i := 0; i < 200; i++ {
+			if err := conn.Send(big); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	It(`serialises concurrent pushes`, func() {
+		c, conn := Connect(apiserver.ServerOpts{})
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				conn.Send(StillAlive{Ping: strings.Repeat(strconv.Itoa(i), 1000)})
+			}(i)
+		}
+		for i := 0; i < 10; i++ {
+			buf, err := c.Await()
+			Expect(err).To(Succeed())
+			Expect(buf).To(MatchRegexp(`^\{"cmds":\[\{"name":"StillAlive","data":\{"ping":"\d{1000}"\}\}\]\}$`))
+		}
+		wg.Wait()
+	})
+	It(`disconnects slow consumer`, func() {
+		c, conn := Connect(apiserver.ServerOpts{
+			SendQueueSize:   1,
+			SendQueuePolicy: apiserver.OverflowDisconnect,
+		})
+		Expect(pushUntilError(conn)).To(Equal(apiserver.ErrSendQueueOverflow))
+		Expect(conn.Send(StillAlive{})).To(Equal(apiserver.ErrConnectionClosed))
+		c.ws.Close()
+	})
+	It(`drops oldest packets`, func() {
+		c, conn := Connect(apiserver.ServerOpts{
+			SendQueueSize:   1,
+			SendQueuePolicy: apiserver.OverflowDropOldest,
+			WriteTimeout:    time.Minute,
+		})
+		// writer gets stuck as client does not read, so every later push replaces the queued one
+		const pushes = 200
+		padding := strings.Repeat(`x`, 256*1024)
+		for i := 0; i < pushes; i++ {
+			Expect(conn.Send(StillAlive{Ping: strconv.Itoa(i) + `:` + padding})).To(Succeed())
+		}
+		var received []int
+		c.ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for len(received) == 0 || received[len(received)-1] != pushes-1 {
+			buf, err := c.Await()
+			Expect(err).To(Succeed())
+			var packet struct {
+				Cmds []struct {
+					Data StillAlive `json:"data"`
+				} `json:"cmds"`
+			}
+			Expect(json.Unmarshal(buf, &packet)).To(Succeed())
+			Expect(packet.Cmds).To(HaveLen(1))
+			n, err := strconv.Atoi(strings.SplitN(packet.Cmds[0].Data.Ping, `:`, 2)[0])
+			Expect(err).To(Succeed())
+			received = append(received, n)
+		}
+		// some packets were dropped, the rest came in order ending with the newest one
+		Expect(len(received)).To(BeNumerically("<", pushes))
+		for i := 1; i < len(received); i++ {
+			Expect(received[i]).To(BeNumerically(">", received[i-1]))
+		}
+		c.ws.Close()
+	})
+	It(`unblocks sender when write deadline expires`, func() {
+		c, conn := Connect(apiserver.ServerOpts{
+			SendQueueSize: 1,
+			WriteTimeout:  100 * time.Millisecond,
+		})
+		Expect(pushUntilError(conn)).To(Equal(apiserver.ErrConnectionClosed))
+		c.ws.Close()
+	})
+})
+
+type goingAway struct{}
+
+func (goingAway) CmdName() string {
+	return `GoingAway`
+}
+
+var _ = Describe("shutdown", func() {
+	It(`drains packets in progress, notifies and closes connections`, func() {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		reasons := make(chan error, 1)
+		router := apiserver.NewRouter()
+		router.RegisterApiHandler(0, `slow`, func(conn apiserver.Conn) (*testEchoResponce, error) {
+			close(started)
+			<-release
+			return &testEchoResponce{Pong: `done`}, nil
+		})
+		server, httpserver, port := startServer(apiserver.ServerOpts{
+			Router: router,
+			NewSessionFn: func() interface{} {
+				return &reasonSession{reasons: reasons}
+			},
+			ShutdownCmd: goingAway{},
+		})
+		defer httpserver.Shutdown(context.Background())
+		c, err := Dial(`127.0.0.1:` + strconv.Itoa(port))
+		Expect(err).To(Succeed())
+		Expect(c.Send([]byte(`{ "cid": 1, "cmds":[{  "name" : "slow" }]}`))).To(Succeed())
+		<-started
+
+		shutdownErr := make(chan error, 1)
+		go func() {
+			shutdownErr <- server.Shutdown(context.Background())
+		}()
+		Consistently(shutdownErr, 50*time.Millisecond).ShouldNot(Receive())
+		_, err = Dial(`127.0.0.1:` + strconv.Itoa(port))
+		Expect(err).To(HaveOccurred())
+
+		close(release)
+		Expect(c.Await()).To(MatchJSON(`{ "cid" : 1, "cmds": [{ "name": "test_echo_responce", "data" : { "pong" : "done" } }]}`))
+		Expect(c.Await()).To(MatchJSON(`{ "cmds": [{ "name": "GoingAway", "data": {} }]}`))
+		_, err = c.Await()
+		Expect(err).To(HaveOccurred())
+		Eventually(shutdownErr).Should(Receive(BeNil()))
+		Expect(reasons).To(Receive(Equal(apiserver.ErrServerShutdown)))
+	})
+	for _, mode := range []apiserver.DispatchMode{apiserver.DispatchOrdered, apiserver.DispatchUnordered} {
+		mode := mode
+		It(`sends replies of concurrent packets before closing, mode `+strconv.Itoa(int(mode)), func() {
+			started := make(chan struct{})
+			release := make(chan struct{})
+			router := apiserver.NewRouter()
+			router.RegisterApiHandler(0, `slow`, func(conn apiserver.Conn) (*testEchoResponce, error) {
+				close(started)
+				<-release
+				return &testEchoResponce{Pong: `slow`}, nil
+			})
+			fastDone := make(chan struct{})
+			router.RegisterApiHandler(0, `fast`, func(conn apiserver.Conn) (*testEchoResponce, error) {
+				close(fastDone)
+				return &testEchoResponce{Pong: `fast`}, nil
+			})
+			server, httpserver, port := startServer(apiserver.ServerOpts{
+				Router:       router,
+				DispatchMode: mode,
+				ShutdownCmd:  goingAway{},
+			})
+			defer httpserver.Shutdown(context.Background())
+			c, err := Dial(`127.0.0.1:` + strconv.Itoa(port))
+			Expect(err).To(Succeed())
+			defer c.ws.Close()
+			Expect(c.Send([]byte(`{ "cid": 1, "cmds":[{  "name" : "slow" }]}`))).To(Succeed())
+			<-started
+			// in ordered mode reply of fast packet waits for the slow one
+			Expect(c.Send([]byte(`{ "cid": 2, "cmds":[{  "name" : "fast" }]}`))).To(Succeed())
+			<-fastDone
+
+			shutdownErr := make(chan error, 1)
+			go func() {
+				shutdownErr <- server.Shutdown(context.Background())
+			}()
+			Consistently(shutdownErr, 50*time.Millisecond).ShouldNot(Receive())
+			close(release)
+			replies := make([]string, 0, 2)
+			for i := 0; i < 2; i++ {
+				buf, err := c.Await()
+				Expect(err).To(Succeed())
+				replies = append(replies, string(buf))
+			}
+			Expect(replies).To(ConsistOf(
+				MatchJSON(`{ "cid" : 1, "cmds": [{ "name": "test_echo_responce", "data" : { "pong" : "slow" } }]}`),
+				MatchJSON(`{ "cid" : 2, "cmds": [{ "name": "test_echo_responce", "data" : { "pong" : "fast" } }]}`),
+			))
+			Expect(c.Await()).To(MatchJSON(`{ "cmds": [{ "name": "GoingAway", "data": {} }]}`))
+			Eventually(shutdownErr).Should(Receive(BeNil()))
+		})
+	}
+	It(`gives up when context is done`, func() {
+		release := make(chan struct{})
+		defer close(release)
+		router := apiserver.NewRouter()
+		router.RegisterApiHandler(0, `slow`, func(conn apiserver.Conn) error {
+			<-release
+			return nil
+		})
+		server, httpserver, port := startServer(apiserver.ServerOpts{Router: router})
+		defer httpserver.Shutdown(context.Background())
+		c, err := Dial(`127.0.0.1:` + strconv.Itoa(port))
+		Expect(err).To(Succeed())
+		defer c.ws.Close()
+		Expect(c.Send([]byte(`{ "cid": 1, "cmds":[{  "name" : "slow" }]}`))).To(Succeed())
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		Eventually(func() error { return server.Shutdown(ctx) }).Should(Equal(context.DeadlineExceeded))
+	})
+})
+
+var _ = Describe("server command timeout", func() {
+	It(`applies to connections of its server only`, func() {
+		router := apiserver.NewRouter()
+		router.RegisterApiHandler(0, `slow`, func(conn apiserver.Conn) (*testEchoResponce, error) {
+			time.Sleep(50 * time.Millisecond)
+			return &testEchoResponce{Pong: `slow`}, nil
+		})
+		_, limited, limitedPort := startServer(apiserver.ServerOpts{Router: router, CommandTimeout: 10 * time.Millisecond})
+		defer limited.Shutdown(context.Background())
+		_, unlimited, unlimitedPort := startServer(apiserver.ServerOpts{Router: router})
+		defer unlimited.Shutdown(context.Background())
+		for port, reply := range map[int]string{
+			limitedPort:   `{ "cid" : 1, "cmds": [{ "name": "Error", "data" : { "type" : "timeout", "msg" : "command timed out after 10ms" } }]}`,
+			unlimitedPort: `{ "cid" : 1, "cmds": [{ "name": "test_echo_responce", "data" : { "pong" : "slow" } }]}`,
+		} {
+			c, err := Dial(`127.0.0.1:` + strconv.Itoa(port))
+			Expect(err).To(Succeed())
+			Expect(c.Send([]byte(`{ "cid": 1, "cmds":[{  "name" : "slow" }]}`))).To(Succeed())
+			Expect(c.Await()).To(MatchJSON(reply))
+			c.ws.Close()
+		}
+	})
+})
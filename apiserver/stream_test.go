@@ -0,0 +1,121 @@
+package apiserver_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/x12tech/go-websocketapi/apiserver"
+)
+
+var _ = Describe("stream server", func() {
+	var (
+		router  *apiserver.Router
+		server  *apiserver.Server
+		reasons chan error
+		// served is closed when Serve returns serveErr
+		served   chan struct{}
+		serveErr error
+	)
+	BeforeEach(func() {
+		reasons = make(chan error, 1)
+		served = make(chan struct{})
+		router = apiserver.NewRouter()
+		router.RegisterApiHandler(0, `cmdname`, func(conn apiserver.Conn, req *testEchoRequest) (*testEchoResponce, error) {
+			conn.Send(StillAlive{Ping: `pushed`})
+			return &testEchoResponce{Pong: req.Ping}, nil
+		})
+		var err error
+		server, err = apiserver.NewServer(apiserver.ServerOpts{
+			Router:         router,
+			MaxMessageSize: 128,
+			NewSessionFn: func() interface{} {
+				return &reasonSession{reasons: reasons}
+			},
+		})
+		Expect(err).To(Succeed())
+	})
+	AfterEach(func() {
+		server.Shutdown(context.Background())
+		Eventually(served).Should(BeClosed())
+		Expect(serveErr).To(Equal(apiserver.ErrServerShutdown))
+	})
+	serveWith := func(network, address string, serve func(l net.Listener) error) net.Conn {
+		l, err := net.Listen(network, address)
+		Expect(err).To(Succeed())
+		go func() {
+			defer close(served)
+			serveErr = serve(l)
+		}()
+		conn, err := net.Dial(network, l.Addr().String())
+		Expect(err).To(Succeed())
+		return conn
+	}
+	serve := func(network, address string) net.Conn {
+		return serveWith(network, address, server.Serve)
+	}
+	await := func(conn net.Conn) []byte {
+		buf, err := apiserver.ReadFrame(conn, 0)
+		Expect(err).To(Succeed())
+		return buf
+	}
+	It(`serves TCP connections`, func() {
+		conn := serve(`tcp`, `127.0.0.1:0`)
+		defer conn.Close()
+		Expect(apiserver.WriteFrame(conn, []byte(`{ "cid": 1, "cmds":[{ "name" : "cmdname", "data" : { "ping" : "tcp" } }]}`))).To(Succeed())
+		Expect(await(conn)).To(MatchJSON(`{ "cmds": [{  "name" : "StillAlive", "data":{"ping":"pushed"} }]}`))
+		Expect(await(conn)).To(MatchJSON(`{ "cid": 1, "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "tcp" } }]}`))
+		Eventually(server.Count).Should(Equal(1))
+		conn.Close()
+		Eventually(reasons).Should(Receive(Equal(apiserver.ErrPeerClosed)))
+		Eventually(server.Count).Should(Equal(0))
+	})
+	It(`serves Unix socket connections`, func() {
+		dir, err := os.MkdirTemp(``, `apiserver`)
+		Expect(err).To(Succeed())
+		defer os.RemoveAll(dir)
+		conn := serve(`unix`, filepath.Join(dir, `api.sock`))
+		defer conn.Close()
+		Expect(apiserver.WriteFrame(conn, []byte(`{ "cid": 2, "cmds":[{ "name" : "cmdname", "data" : { "ping" : "unix" } }]}`))).To(Succeed())
+		Expect(await(conn)).To(MatchJSON(`{ "cmds": [{  "name" : "StillAlive", "data":{"ping":"pushed"} }]}`))
+		Expect(await(conn)).To(MatchJSON(`{ "cid": 2, "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "unix" } }]}`))
+	})
+	It(`exchanges packets encoded by codec missing from ServerOpts.Codecs`, func() {
+		var err error
+		server, err = apiserver.NewServer(apiserver.ServerOpts{
+			Router: router,
+			Codecs: []apiserver.Codec{apiserver.JSONCodec},
+		})
+		Expect(err).To(Succeed())
+		conn := serveWith(`tcp`, `127.0.0.1:0`, func(l net.Listener) error {
+			return server.ServeCodec(l, apiserver.MsgpackCodec)
+		})
+		defer conn.Close()
+		Expect(apiserver.WriteFrame(conn, encodeMsgpack(testPacket(3, `cmdname`, map[string]interface{}{`ping`: `packed`})))).To(Succeed())
+		Expect(decodeMsgpack(await(conn)).Cmds).To(Equal([]testReplyCommand{{Name: `StillAlive`, Data: map[string]interface{}{`ping`: `pushed`}}}))
+		Expect(decodeMsgpack(await(conn))).To(Equal(testReply{Cid: 3, Cmds: []testReplyCommand{{Name: `test_echo_responce`, Data: map[string]interface{}{`pong`: `packed`}}}}))
+	})
+	It(`answers too large packet and closes`, func() {
+		conn := serve(`tcp`, `127.0.0.1:0`)
+		defer conn.Close()
+		Expect(apiserver.WriteFrame(conn, make([]byte, 129))).To(Succeed())
+		Expect(await(conn)).To(MatchJSON(`{ "cmds":[{ "name" : "Error", "data" : { "type" : "message_too_large", "msg" : "message exceeds 128 bytes" } }]}`))
+		Eventually(reasons).Should(Receive(Equal(apiserver.ErrMessageTooLarge)))
+		_, err := apiserver.ReadFrame(conn, 0)
+		Expect(err).To(HaveOccurred())
+	})
+	It(`closes connections on shutdown`, func() {
+		conn := serve(`tcp`, `127.0.0.1:0`)
+		defer conn.Close()
+		Eventually(server.Count).Should(Equal(1))
+		Expect(server.Shutdown(context.Background())).To(Succeed())
+		Eventually(served).Should(BeClosed())
+		Expect(serveErr).To(Equal(apiserver.ErrServerShutdown))
+		Expect(reasons).To(Receive(Equal(apiserver.ErrServerShutdown)))
+		_, err := apiserver.ReadFrame(conn, 0)
+		Expect(err).To(HaveOccurred())
+	})
+})
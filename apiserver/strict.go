@@ -0,0 +1,50 @@
+package apiserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type strictKey struct{}
+
+// EnableStrictDecoding rejects command data with unknown fields, JSON data with trailing data
+// and decodes JSON numbers into interface{} as json.Number for connections of fromVersion and newer,
+// so older clients keep lenient decoding
+func (self *Router) EnableStrictDecoding(fromVersion int) {
+	self.strict = true
+	self.strictFromVersion = fromVersion
+}
+
+func (self *Router) strictDecoding(version int) bool {
+	return self.strict && version >= self.strictFromVersion
+}
+
+func withStrictDecoding(ctx context.Context) context.Context {
+	return context.WithValue(ctx, strictKey{}, true)
+}
+
+func isStrictDecoding(ctx context.Context) bool {
+	strict, _ := ctx.Value(strictKey{}).(bool)
+	return strict
+}
+
+func decodeStrict(data []byte, input interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	if err := dec.Decode(input); err != nil {
+		if strings.HasPrefix(err.Error(), `json: unknown field `) {
+			return ApiError(`unknown_field`, strings.TrimPrefix(err.Error(), `json: `))
+		}
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New(`trailing data after command data`)
+	}
+	return nil
+}
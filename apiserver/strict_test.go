@@ -0,0 +1,53 @@
+package apiserver_test
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/x12tech/go-websocketapi/apiserver"
+)
+
+type testAnyRequest struct {
+	Ping  string      `json:"ping"`
+	Value interface{} `json:"value"`
+}
+
+var _ = Describe("strict decoding", func() {
+	var (
+		router *apiserver.Router
+		conn   *apiserver.FakeConn
+		value  interface{}
+	)
+	BeforeEach(func() {
+		router = apiserver.NewRouter()
+		router.EnableStrictDecoding(2)
+		conn = apiserver.NewFakeConn()
+		router.RegisterApiHandler(0, `cmdname`, func(conn apiserver.Conn, req *testAnyRequest) (*testEchoResponce, error) {
+			value = req.Value
+			return &testEchoResponce{Pong: req.Ping}, nil
+		})
+	})
+	var Written = func() string {
+		conn.Mu.Lock()
+		defer conn.Mu.Unlock()
+		return string(conn.Written[len(conn.Written)-1])
+	}
+	It(`ignores unknown fields of older versions`, func() {
+		conn.SetVersion(1)
+		router.ProcessPacket(conn, []byte(`{ "cid": 1, "cmds":[{ "name" : "cmdname", "data" : { "ping" : "test", "pong" : "typo", "value" : 12 } }]}`))
+		Expect(Written()).To(MatchJSON(`{ "cid": 1, "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "test" } }]}`))
+		Expect(value).To(Equal(float64(12)))
+	})
+	It(`rejects unknown fields`, func() {
+		conn.SetVersion(2)
+		router.ProcessPacket(conn, []byte(`{ "cid": 1, "cmds":[{ "name" : "cmdname", "data" : { "ping" : "test", "pong" : "typo" } }]}`))
+		Expect(Written()).To(MatchJSON(`{ "cid": 1, "cmds":[{ "name" : "Error", "data" : { "type" : "unknown_field", "msg" : "unknown field \"pong\"" } }]}`))
+	})
+	It(`decodes numbers as json.Number`, func() {
+		conn.SetVersion(3)
+		router.ProcessPacket(conn, []byte(`{ "cid": 1, "cmds":[{ "name" : "cmdname", "data" : { "ping" : "test", "value" : 12345678901234567890 } }]}`))
+		Expect(Written()).To(MatchJSON(`{ "cid": 1, "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "test" } }]}`))
+		Expect(value).To(Equal(json.Number(`12345678901234567890`)))
+	})
+})
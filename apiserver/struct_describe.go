@@ -21,6 +21,46 @@ func (self *Describer) Describe(t reflect.Type) interface{} {
 	return self.describeType(t)
 }
 
+// Constraints returns validate rules of fields of t by their path, like "items[].name", nil if there are none
+func (self *Describer) Constraints(t reflect.Type) map[string]string {
+	self.visitedTypes = make(map[reflect.Type]struct{})
+	constraints := make(map[string]string)
+	self.collectConstraints(t, ``, constraints)
+	if len(constraints) == 0 {
+		return nil
+	}
+	return constraints
+}
+
+func (self *Describer) collectConstraints(t reflect.Type, path string, constraints map[string]string) {
+	if t == nil {
+		return
+	}
+	t, _ = ptrType(t)
+	if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		self.collectConstraints(t.Elem(), path+`[]`, constraints)
+		return
+	}
+	if t.Kind() != reflect.Struct || self.visited(t) {
+		return
+	}
+	defer self.unvisited(t)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _ := getFiledName(f)
+		if name == `` || name == `-` {
+			continue
+		}
+		if path != `` {
+			name = path + `.` + name
+		}
+		if rules := f.Tag.Get(validateTag); rules != `` {
+			constraints[name] = rules
+		}
+		self.collectConstraints(f.Type, name, constraints)
+	}
+}
+
 func (self *Describer) visited(t reflect.Type) bool {
 	if t.Kind() != reflect.Struct {
 		return false
@@ -0,0 +1,97 @@
+package apiserver
+
+import (
+	"context"
+	"runtime/debug"
+	"time"
+)
+
+// LateResultLogger may be implemented by CmdLogger to log results of commands
+// which exceeded their timeout, client got timeout error instead of them
+type LateResultLogger interface {
+	LogLateResult(session interface{}, command string, out []CmdNamer, err error)
+}
+
+// WithTimeout registers handlers which are timed out after d instead of router default
+func (self *Router) WithTimeout(d time.Duration) *middlewareWrapper {
+	return &middlewareWrapper{
+		router:  self,
+		timeout: d,
+	}
+}
+
+func (self *middlewareWrapper) WithTimeout(d time.Duration) *middlewareWrapper {
+	return &middlewareWrapper{
+		funcs:   self.funcs,
+		router:  self.router,
+		timeout: d,
+	}
+}
+
+type commandTimeoutKey struct{}
+
+// withCommandTimeout overrides router command timeout for commands of connection with ctx
+func withCommandTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, commandTimeoutKey{}, d)
+}
+
+type callResult struct {
+	cmds []CmdNamer
+	err  error
+}
+
+// call runs handler in its own goroutine when timeout is set,
+// so timed out command is answered while handler is still running
+func (self *Router) call(ctx context.Context, h *handler, conn Conn, command string, data []byte) ([]CmdNamer, error) {
+	timeout := self.commandTimeout
+	if d, ok := ctx.Value(commandTimeoutKey{}).(time.Duration); ok {
+		timeout = d
+	}
+	if h.Timeout > 0 {
+		timeout = h.Timeout
+	}
+	if timeout <= 0 {
+		return h.CallContext(ctx, conn, data)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	done := make(chan callResult)
+	expired := make(chan struct{})
+	go func() {
+		defer cancel()
+		res := self.recoverCall(h, ctx, conn, command, data)
+		select {
+		case done <- res:
+		case <-expired:
+			self.logLateResult(conn, command, res)
+		}
+	}()
+	select {
+	case res := <-done:
+		return res.cmds, res.err
+	case <-ctx.Done():
+		if ctx.Err() != context.DeadlineExceeded {
+			// connection is closed, there is no one to reply to
+			res := <-done
+			return res.cmds, res.err
+		}
+		close(expired)
+		return []CmdNamer{ApiError(`timeout`, `command timed out after `+timeout.String())}, nil
+	}
+}
+
+// recoverCall is used out of ProcessCommand goroutine, so it recovers panic by itself
+func (self *Router) recoverCall(h *handler, ctx context.Context, conn Conn, command string, data []byte) (res callResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			res = callResult{cmds: []CmdNamer{self.internalError(conn, command, r, debug.Stack())}}
+		}
+	}()
+	cmds, err := h.CallContext(ctx, conn, data)
+	return callResult{cmds, err}
+}
+
+func (self *Router) logLateResult(conn Conn, command string, res callResult) {
+	if logger, ok := self.cmdLogger.(LateResultLogger); ok {
+		logger.LogLateResult(conn.Session(), command, res.cmds, res.err)
+	}
+}
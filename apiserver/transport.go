@@ -0,0 +1,66 @@
+package apiserver
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Transport is a websocket connection Connection reads and writes whole messages with,
+// so the same Router runs on any websocket library adapted to it
+type Transport interface {
+	// Request is the http request connection was upgraded from
+	Request() *http.Request
+	// Subprotocol is agreed during handshake, empty if none
+	Subprotocol() string
+	// ReadMessage returns ErrMessageTooLarge when message exceeds TransportOpts.MaxMessageSize
+	// and io.EOF when peer closed connection
+	ReadMessage() ([]byte, error)
+	// WriteMessage sends buf in binary or text frame, it is never called concurrently
+	WriteMessage(buf []byte, binary bool) error
+	Ping() error
+	// LastRead returns time of the last frame received from peer, pongs included,
+	// ok is false if transport cannot track it
+	LastRead() (t time.Time, ok bool)
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	// Close sends close frame with code and reason and closes connection
+	Close(code int, reason string) error
+}
+
+// codecTransport is a Transport whose codec is fixed by listener instead of negotiated subprotocol
+type codecTransport interface {
+	wireCodec() Codec
+}
+
+// TransportOpts are applied by Upgrader to every connection
+type TransportOpts struct {
+	MaxMessageSize int
+	// Compression negotiates permessage-deflate with clients offering it
+	Compression bool
+	// CompressionLevel is a compress/flate level
+	CompressionLevel int
+	// CompressionThreshold is the least message size in bytes to be compressed
+	CompressionThreshold int
+	// PongTimeout bounds Ping of transports waiting for pong
+	PongTimeout time.Duration
+}
+
+// Upgrader accepts websocket handshake answering with subprotocol if it is not empty,
+// and calls handle with established connection. Connection is done when handle returns.
+type Upgrader interface {
+	Upgrade(w http.ResponseWriter, req *http.Request, subprotocol string, opts TransportOpts, handle func(Transport))
+}
+
+// offeredSubprotocols returns subprotocols of Sec-WebSocket-Protocol header in client preference order
+func offeredSubprotocols(req *http.Request) []string {
+	var protocols []string
+	for _, header := range req.Header[`Sec-Websocket-Protocol`] {
+		for _, protocol := range strings.Split(header, `,`) {
+			if protocol = strings.TrimSpace(protocol); protocol != `` {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
@@ -0,0 +1,180 @@
+package apiserver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// CoderOpts configure NewCoderUpgrader
+type CoderOpts struct {
+	// OriginPatterns are hosts allowed to open connections besides the host of request, e.g. "*.example.com"
+	OriginPatterns []string
+	// InsecureSkipOriginCheck accepts any Origin, leaving connections open to cross-site websocket hijacking
+	InsecureSkipOriginCheck bool
+}
+
+type coderUpgrader struct {
+	opts CoderOpts
+}
+
+// NewCoderUpgrader accepts connections with github.com/coder/websocket, former nhooyr.io/websocket.
+// It supports compression, but not compression level. Origin must match the host of request or
+// one of OriginPatterns, unless InsecureSkipOriginCheck is set.
+func NewCoderUpgrader(opts CoderOpts) Upgrader {
+	return coderUpgrader{opts: opts}
+}
+
+func (self coderUpgrader) Upgrade(w http.ResponseWriter, req *http.Request, subprotocol string, opts TransportOpts, handle func(Transport)) {
+	acceptOpts := &websocket.AcceptOptions{
+		OriginPatterns:     self.opts.OriginPatterns,
+		InsecureSkipVerify: self.opts.InsecureSkipOriginCheck,
+	}
+	if subprotocol != `` {
+		acceptOpts.Subprotocols = []string{subprotocol}
+	}
+	if opts.Compression {
+		acceptOpts.CompressionMode = websocket.CompressionContextTakeover
+		acceptOpts.CompressionThreshold = opts.CompressionThreshold
+	}
+	t := &coderTransport{
+		req:  req,
+		opts: opts,
+	}
+	t.touch()
+	acceptOpts.OnPongReceived = func(context.Context, []byte) {
+		t.touch()
+	}
+	conn, err := websocket.Accept(w, req, acceptOpts)
+	if err != nil {
+		// Accept has already replied with http error
+		return
+	}
+	// limit is checked by ReadMessage, as coder closes connection itself before message_too_large error is sent
+	conn.SetReadLimit(-1)
+	t.conn = conn
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	handle(t)
+}
+
+// coderTransport emulates deadlines with contexts, expired context closes coder connection
+type coderTransport struct {
+	conn          *websocket.Conn
+	req           *http.Request
+	opts          TransportOpts
+	lastRead      int64
+	pinging       int32
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// ctx is cancelled on Close and stops pings waiting for pong
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (self *coderTransport) touch() {
+	atomic.StoreInt64(&self.lastRead, time.Now().UnixNano())
+}
+
+func (self *coderTransport) Request() *http.Request {
+	return self.req
+}
+
+func (self *coderTransport) Subprotocol() string {
+	return self.conn.Subprotocol()
+}
+
+func (self *coderTransport) withDeadline(deadline time.Time) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return context.WithCancel(self.ctx)
+	}
+	return context.WithDeadline(self.ctx, deadline)
+}
+
+func (self *coderTransport) ReadMessage() ([]byte, error) {
+	ctx, cancel := self.withDeadline(self.readDeadline)
+	defer cancel()
+	_, r, err := self.conn.Reader(ctx)
+	if err != nil {
+		return nil, coderError(ctx, err)
+	}
+	self.touch()
+	if self.opts.MaxMessageSize <= 0 {
+		buf, err := io.ReadAll(r)
+		if err != nil {
+			return nil, coderError(ctx, err)
+		}
+		return buf, nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(r, int64(self.opts.MaxMessageSize)+1))
+	if err != nil {
+		return nil, coderError(ctx, err)
+	}
+	if len(buf) > self.opts.MaxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+	return buf, nil
+}
+
+// coderError makes errors look like net ones Connection expects
+func coderError(ctx context.Context, err error) error {
+	if websocket.CloseStatus(err) != -1 {
+		return io.EOF
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
+
+func (self *coderTransport) WriteMessage(buf []byte, binary bool) error {
+	ctx, cancel := self.withDeadline(self.writeDeadline)
+	defer cancel()
+	typ := websocket.MessageText
+	if binary {
+		typ = websocket.MessageBinary
+	}
+	return coderError(ctx, self.conn.Write(ctx, typ, buf))
+}
+
+// Ping is sent in background, as coder waits for pong, which is noticed by LastRead.
+// One ping is in flight at a time, it is given up after TransportOpts.PongTimeout.
+func (self *coderTransport) Ping() error {
+	if !atomic.CompareAndSwapInt32(&self.pinging, 0, 1) {
+		return nil
+	}
+	go func() {
+		defer atomic.StoreInt32(&self.pinging, 0)
+		ctx, cancel := self.ctx, context.CancelFunc(func() {})
+		if self.opts.PongTimeout > 0 {
+			ctx, cancel = context.WithTimeout(self.ctx, self.opts.PongTimeout)
+		}
+		defer cancel()
+		self.conn.Ping(ctx)
+	}()
+	return nil
+}
+
+func (self *coderTransport) LastRead() (time.Time, bool) {
+	return time.Unix(0, atomic.LoadInt64(&self.lastRead)), true
+}
+
+func (self *coderTransport) SetReadDeadline(t time.Time) error {
+	self.readDeadline = t
+	return nil
+}
+
+func (self *coderTransport) SetWriteDeadline(t time.Time) error {
+	self.writeDeadline = t
+	return nil
+}
+
+// Close completes close handshake, coder waits for close frame of peer up to 5 seconds
+func (self *coderTransport) Close(code int, reason string) error {
+	defer self.cancel()
+	return self.conn.Close(websocket.StatusCode(code), reason)
+}
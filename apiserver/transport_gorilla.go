@@ -0,0 +1,134 @@
+package apiserver
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+)
+
+type gorillaUpgrader struct{}
+
+// NewGorillaUpgrader accepts connections with github.com/gorilla/websocket, it supports compression.
+// Origin is not checked, like x/net/websocket server does not.
+func NewGorillaUpgrader() Upgrader {
+	return gorillaUpgrader{}
+}
+
+func (gorillaUpgrader) Upgrade(w http.ResponseWriter, req *http.Request, subprotocol string, opts TransportOpts, handle func(Transport)) {
+	upgrader := gorilla.Upgrader{
+		EnableCompression: opts.Compression,
+		CheckOrigin:       func(*http.Request) bool { return true },
+	}
+	var header http.Header
+	if subprotocol != `` {
+		header = http.Header{`Sec-Websocket-Protocol`: {subprotocol}}
+	}
+	conn, err := upgrader.Upgrade(w, req, header)
+	if err != nil {
+		// upgrader has already replied with http error
+		return
+	}
+	if opts.Compression {
+		conn.SetCompressionLevel(opts.CompressionLevel)
+	}
+	handle(newGorillaTransport(conn, req, opts))
+}
+
+type gorillaTransport struct {
+	conn          *gorilla.Conn
+	req           *http.Request
+	opts          TransportOpts
+	lastRead      int64
+	writeDeadline time.Time
+}
+
+func newGorillaTransport(conn *gorilla.Conn, req *http.Request, opts TransportOpts) *gorillaTransport {
+	self := &gorillaTransport{
+		conn: conn,
+		req:  req,
+		opts: opts,
+	}
+	self.touch()
+	conn.SetPongHandler(func(string) error {
+		self.touch()
+		return nil
+	})
+	return self
+}
+
+func (self *gorillaTransport) touch() {
+	atomic.StoreInt64(&self.lastRead, time.Now().UnixNano())
+}
+
+func (self *gorillaTransport) Request() *http.Request {
+	return self.req
+}
+
+func (self *gorillaTransport) Subprotocol() string {
+	return self.conn.Subprotocol()
+}
+
+// ReadMessage limits message by hand, as gorilla closes connection itself on read limit
+// before message_too_large error is sent
+func (self *gorillaTransport) ReadMessage() ([]byte, error) {
+	_, r, err := self.conn.NextReader()
+	if err != nil {
+		return nil, gorillaReadError(err)
+	}
+	self.touch()
+	if self.opts.MaxMessageSize <= 0 {
+		buf, err := io.ReadAll(r)
+		return buf, gorillaReadError(err)
+	}
+	buf, err := io.ReadAll(io.LimitReader(r, int64(self.opts.MaxMessageSize)+1))
+	if err != nil {
+		return nil, gorillaReadError(err)
+	}
+	if len(buf) > self.opts.MaxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+	return buf, nil
+}
+
+func gorillaReadError(err error) error {
+	if _, ok := err.(*gorilla.CloseError); ok {
+		return io.EOF
+	}
+	return err
+}
+
+func (self *gorillaTransport) WriteMessage(buf []byte, binary bool) error {
+	if self.opts.Compression {
+		self.conn.EnableWriteCompression(len(buf) >= self.opts.CompressionThreshold)
+	}
+	typ := gorilla.TextMessage
+	if binary {
+		typ = gorilla.BinaryMessage
+	}
+	return self.conn.WriteMessage(typ, buf)
+}
+
+func (self *gorillaTransport) Ping() error {
+	return self.conn.WriteControl(gorilla.PingMessage, nil, self.writeDeadline)
+}
+
+func (self *gorillaTransport) LastRead() (time.Time, bool) {
+	return time.Unix(0, atomic.LoadInt64(&self.lastRead)), true
+}
+
+func (self *gorillaTransport) SetReadDeadline(t time.Time) error {
+	return self.conn.SetReadDeadline(t)
+}
+
+func (self *gorillaTransport) SetWriteDeadline(t time.Time) error {
+	self.writeDeadline = t
+	return self.conn.SetWriteDeadline(t)
+}
+
+func (self *gorillaTransport) Close(code int, reason string) error {
+	self.conn.WriteControl(gorilla.CloseMessage, gorilla.FormatCloseMessage(code, reason), self.writeDeadline)
+	return self.conn.Close()
+}
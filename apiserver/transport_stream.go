@@ -0,0 +1,155 @@
+package apiserver
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// frameHeaderSize is the size of big endian uint32 length preceding every packet on a stream
+const frameHeaderSize = 4
+
+// ReadFrame reads a length prefixed packet, ErrMessageTooLarge is returned without reading it if it exceeds maxSize
+func ReadFrame(r io.Reader, maxSize int) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if maxSize > 0 && int64(size) > int64(maxSize) {
+		return nil, ErrMessageTooLarge
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// WriteFrame writes buf prefixed with its length
+func WriteFrame(w io.Writer, buf []byte) error {
+	if uint64(len(buf)) > uint64(^uint32(0)) {
+		return ErrMessageTooLarge
+	}
+	frame := make([]byte, frameHeaderSize+len(buf))
+	binary.BigEndian.PutUint32(frame, uint32(len(buf)))
+	copy(frame[frameHeaderSize:], buf)
+	_, err := w.Write(frame)
+	return err
+}
+
+// streamTransport frames packets on a TCP or Unix socket, it has no control frames,
+// so pings are not sent and close code is not delivered
+type streamTransport struct {
+	conn  net.Conn
+	codec Codec
+	opts  TransportOpts
+}
+
+func newStreamTransport(conn net.Conn, codec Codec, opts TransportOpts) *streamTransport {
+	return &streamTransport{
+		conn:  conn,
+		codec: codec,
+		opts:  opts,
+	}
+}
+
+// Request is nil, as connection is not upgraded from http
+func (self *streamTransport) Request() *http.Request {
+	return nil
+}
+
+func (self *streamTransport) Subprotocol() string {
+	return self.codec.Subprotocol()
+}
+
+func (self *streamTransport) wireCodec() Codec {
+	return self.codec
+}
+
+func (self *streamTransport) ReadMessage() ([]byte, error) {
+	return ReadFrame(self.conn, self.opts.MaxMessageSize)
+}
+
+func (self *streamTransport) WriteMessage(buf []byte, binary bool) error {
+	return WriteFrame(self.conn, buf)
+}
+
+func (self *streamTransport) Ping() error {
+	return nil
+}
+
+func (self *streamTransport) LastRead() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (self *streamTransport) SetReadDeadline(t time.Time) error {
+	return self.conn.SetReadDeadline(t)
+}
+
+func (self *streamTransport) SetWriteDeadline(t time.Time) error {
+	return self.conn.SetWriteDeadline(t)
+}
+
+func (self *streamTransport) Close(code int, reason string) error {
+	return self.conn.Close()
+}
+
+// Serve accepts connections of TCP or Unix socket listener, which exchange JSON packets
+// framed by WriteFrame, until listener fails or server is shut down
+func (self *Server) Serve(l net.Listener) error {
+	return self.ServeCodec(l, JSONCodec)
+}
+
+// ServeCodec is Serve exchanging packets encoded by codec, it need not be one of ServerOpts.Codecs
+func (self *Server) ServeCodec(l net.Listener, codec Codec) error {
+	if !self.trackListener(l) {
+		l.Close()
+		return ErrServerShutdown
+	}
+	defer self.untrackListener(l)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if self.isShuttingDown() {
+				return ErrServerShutdown
+			}
+			return errors.Wrap(err, `accept`)
+		}
+		go self.serveTransport(newStreamTransport(conn, codec, self.transportOpts))
+	}
+}
+
+func (self *Server) trackListener(l net.Listener) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.shuttingDown {
+		return false
+	}
+	if self.listeners == nil {
+		self.listeners = make(map[net.Listener]struct{})
+	}
+	self.listeners[l] = struct{}{}
+	return true
+}
+
+func (self *Server) untrackListener(l net.Listener) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.listeners, l)
+}
+
+func (self *Server) closeListeners() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for l := range self.listeners {
+		l.Close()
+	}
+}
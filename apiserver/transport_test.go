@@ -0,0 +1,203 @@
+package apiserver_test
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/x12tech/go-websocketapi/apiserver"
+	"golang.org/x/net/websocket"
+)
+
+var _ = Describe("transport", func() {
+	upgraders := map[string]func() apiserver.Upgrader{
+		`x/net`:   apiserver.NewXNetUpgrader,
+		`gorilla`: apiserver.NewGorillaUpgrader,
+		`coder`: func() apiserver.Upgrader {
+			return apiserver.NewCoderUpgrader(apiserver.CoderOpts{OriginPatterns: []string{`127.0.0.1`}})
+		},
+	}
+	for name, newUpgrader := range upgraders {
+		newUpgrader := newUpgrader
+		Describe(name, func() {
+			var (
+				router     *apiserver.Router
+				httpserver *http.Server
+				port       int
+				reasons    chan error
+			)
+			BeforeEach(func() {
+				reasons = make(chan error, 1)
+				router = apiserver.NewRouter()
+				router.RegisterApiHandler(0, `cmdname`, func(conn apiserver.Conn, req *testEchoRequest) (*testEchoResponce, error) {
+					conn.Send(StillAlive{Ping: `pushed`})
+					return &testEchoResponce{Pong: req.Ping}, nil
+				})
+			})
+			AfterEach(func() {
+				httpserver.Shutdown(context.Background())
+			})
+			start := func(opts apiserver.ServerOpts) {
+				opts.Router = router
+				opts.Upgrader = newUpgrader()
+				opts.NewSessionFn = func() interface{} {
+					return &reasonSession{reasons: reasons}
+				}
+				_, httpserver, port = startServer(opts)
+			}
+			connect := func(opts apiserver.ServerOpts) *ApiClient {
+				start(opts)
+				c, err := Dial(`127.0.0.1:` + strconv.Itoa(port))
+				Expect(err).To(Succeed())
+				return c
+			}
+			It(`replies and pushes`, func() {
+				c := connect(apiserver.ServerOpts{})
+				defer c.ws.Close()
+				Expect(c.Send([]byte(`{ "cid": 1, "cmds":[{ "name" : "cmdname", "data" : { "ping" : "text" } }]}`))).To(Succeed())
+				Expect(c.Await()).To(MatchJSON(`{ "cmds": [{  "name" : "StillAlive", "data":{"ping":"pushed"} }]}`))
+				Expect(c.Await()).To(MatchJSON(`{ "cid": 1, "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "text" } }]}`))
+				c.ws.Close()
+				Eventually(reasons).Should(Receive(Equal(apiserver.ErrPeerClosed)))
+			})
+			It(`chooses codec by subprotocol`, func() {
+				start(apiserver.ServerOpts{})
+				c := DialProtocol(`127.0.0.1:`+strconv.Itoa(port), `msgpack`)
+				defer c.ws.Close()
+				Expect(c.ws.Config().Protocol).To(Equal([]string{`msgpack`}))
+				c.ws.PayloadType = websocket.BinaryFrame
+				Expect(c.Send(encodeMsgpack(testPacket(7, `cmdname`, map[string]interface{}{`ping`: `packed`})))).To(Succeed())
+				var frame []byte
+				Expect(websocket.Message.Receive(c.ws, &frame)).To(Succeed())
+				Expect(websocket.Message.Receive(c.ws, &frame)).To(Succeed())
+				Expect(decodeMsgpack(frame).Cmds).To(Equal([]testReplyCommand{{Name: `test_echo_responce`, Data: map[string]interface{}{`pong`: `packed`}}}))
+			})
+			It(`closes too large message with its code`, func() {
+				start(apiserver.ServerOpts{MaxMessageSize: 64})
+				ws, _, err := gorilla.DefaultDialer.Dial(`ws://127.0.0.1:`+strconv.Itoa(port)+`/`, nil)
+				Expect(err).To(Succeed())
+				defer ws.Close()
+				Expect(ws.WriteMessage(gorilla.TextMessage, []byte(`{ "cid": 1, "cmds":[{ "name" : "cmdname", "data" : { "ping" : "too long to fit in sixty four bytes" } }]}`))).To(Succeed())
+				_, buf, err := ws.ReadMessage()
+				Expect(err).To(Succeed())
+				Expect(buf).To(MatchJSON(`{ "cmds":[{ "name" : "Error", "data" : { "type" : "message_too_large", "msg" : "message exceeds 64 bytes" } }]}`))
+				_, _, err = ws.ReadMessage()
+				Expect(err).To(BeAssignableToTypeOf(&gorilla.CloseError{}))
+				Expect(err.(*gorilla.CloseError).Code).To(Equal(apiserver.CloseMessageTooBig))
+				Expect(err.(*gorilla.CloseError).Text).To(Equal(apiserver.ErrMessageTooLarge.Error()))
+				Eventually(reasons).Should(Receive(Equal(apiserver.ErrMessageTooLarge)))
+			})
+			It(`closes connection when peer does not answer pings`, func() {
+				c := connect(apiserver.ServerOpts{
+					PingInterval: 20 * time.Millisecond,
+					PongTimeout:  20 * time.Millisecond,
+				})
+				defer c.ws.Close()
+				Eventually(reasons).Should(Receive(Equal(apiserver.ErrPongTimeout)))
+			})
+			It(`keeps connection answering pings alive`, func() {
+				c := connect(apiserver.ServerOpts{
+					PingInterval: 20 * time.Millisecond,
+					PongTimeout:  20 * time.Millisecond,
+				})
+				go func() {
+					for {
+						if _, err := c.Await(); err != nil {
+							return
+						}
+					}
+				}()
+				Consistently(reasons, 200*time.Millisecond).ShouldNot(Receive())
+				c.ws.Close()
+				Eventually(reasons).Should(Receive(Equal(apiserver.ErrPeerClosed)))
+			})
+			It(`closes idle connection`, func() {
+				c := connect(apiserver.ServerOpts{
+					IdleTimeout: 50 * time.Millisecond,
+				})
+				defer c.ws.Close()
+				Eventually(reasons).Should(Receive(Equal(apiserver.ErrIdleTimeout)))
+			})
+		})
+	}
+})
+
+var _ = Describe("coder origin", func() {
+	var (
+		httpserver *http.Server
+		port       int
+	)
+	AfterEach(func() {
+		httpserver.Shutdown(context.Background())
+	})
+	// dial sends origin of server itself if origin is empty
+	dial := func(opts apiserver.CoderOpts, origin string) (*http.Response, error) {
+		_, httpserver, port = startServer(apiserver.ServerOpts{
+			Router:   apiserver.NewRouter(),
+			Upgrader: apiserver.NewCoderUpgrader(opts),
+		})
+		if origin == `` {
+			origin = `http://127.0.0.1:` + strconv.Itoa(port)
+		}
+		ws, resp, err := gorilla.DefaultDialer.Dial(`ws://127.0.0.1:`+strconv.Itoa(port)+`/`, http.Header{`Origin`: {origin}})
+		if err == nil {
+			ws.Close()
+		}
+		return resp, err
+	}
+	It(`accepts origin of request host`, func() {
+		_, err := dial(apiserver.CoderOpts{}, ``)
+		Expect(err).To(Succeed())
+	})
+	It(`rejects foreign origin`, func() {
+		resp, err := dial(apiserver.CoderOpts{}, `http://evil.example.com`)
+		Expect(err).To(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+	})
+	It(`accepts origin matching patterns`, func() {
+		_, err := dial(apiserver.CoderOpts{OriginPatterns: []string{`*.example.com`}}, `http://app.example.com`)
+		Expect(err).To(Succeed())
+	})
+	It(`accepts any origin when check is skipped`, func() {
+		_, err := dial(apiserver.CoderOpts{InsecureSkipOriginCheck: true}, `http://evil.example.com`)
+		Expect(err).To(Succeed())
+	})
+})
+
+var _ = Describe("coder keepalive", func() {
+	It(`does not hold replies while waiting for pong`, func() {
+		router := apiserver.NewRouter()
+		router.RegisterApiHandler(0, `cmdname`, func(conn apiserver.Conn, req *testEchoRequest) (*testEchoResponce, error) {
+			return &testEchoResponce{Pong: req.Ping}, nil
+		})
+		_, httpserver, port := startServer(apiserver.ServerOpts{
+			Router:       router,
+			Upgrader:     apiserver.NewCoderUpgrader(apiserver.CoderOpts{}),
+			PingInterval: 20 * time.Millisecond,
+			PongTimeout:  time.Second,
+		})
+		defer httpserver.Shutdown(context.Background())
+		ws, _, err := gorilla.DefaultDialer.Dial(`ws://127.0.0.1:`+strconv.Itoa(port)+`/`, nil)
+		Expect(err).To(Succeed())
+		defer ws.Close()
+		// peer never answers pings
+		ws.SetPingHandler(func(string) error { return nil })
+		replies := make(chan []byte, 1)
+		go func() {
+			for {
+				_, buf, err := ws.ReadMessage()
+				if err != nil {
+					return
+				}
+				replies <- buf
+			}
+		}()
+		time.Sleep(50 * time.Millisecond)
+		Expect(ws.WriteMessage(gorilla.TextMessage, []byte(`{ "cid": 1, "cmds":[{ "name" : "cmdname", "data" : { "ping" : "text" } }]}`))).To(Succeed())
+		Eventually(replies, 300*time.Millisecond).Should(Receive(MatchJSON(`{ "cid": 1, "cmds":[{ "name" : "test_echo_responce", "data" : { "pong" : "text" } }]}`)))
+	})
+})
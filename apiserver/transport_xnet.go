@@ -0,0 +1,129 @@
+package apiserver
+
+import (
+	"encoding/binary"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// pingCodec sends an empty ping control frame, x/net/websocket has no other way to do it
+var pingCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		return nil, websocket.PingFrame, nil
+	},
+}
+
+type closeFrame struct {
+	code   int
+	reason string
+}
+
+// closeCodec sends a close frame with closeFrame status code and reason
+var closeCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		frame := v.(closeFrame)
+		msg := make([]byte, 2, 2+len(frame.reason))
+		binary.BigEndian.PutUint16(msg, uint16(frame.code))
+		return append(msg, frame.reason...), websocket.CloseFrame, nil
+	},
+}
+
+type xnetUpgrader struct{}
+
+// NewXNetUpgrader accepts connections with golang.org/x/net/websocket, it does not support compression
+func NewXNetUpgrader() Upgrader {
+	return xnetUpgrader{}
+}
+
+func (xnetUpgrader) Upgrade(w http.ResponseWriter, req *http.Request, subprotocol string, opts TransportOpts, handle func(Transport)) {
+	act := new(activity)
+	act.touch()
+	server := websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			config.Protocol = nil
+			if subprotocol != `` {
+				config.Protocol = []string{subprotocol}
+			}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			handle(newXNetTransport(ws, opts))
+		},
+	}
+	server.ServeHTTP(&activityResponseWriter{ResponseWriter: w, act: act}, withActivity(req, act))
+}
+
+type xnetTransport struct {
+	ws *websocket.Conn
+	// act is known when connection is upgraded by xnetUpgrader
+	act *activity
+}
+
+func newXNetTransport(ws *websocket.Conn, opts TransportOpts) *xnetTransport {
+	if opts.MaxMessageSize > 0 {
+		ws.MaxPayloadBytes = opts.MaxMessageSize
+	}
+	return &xnetTransport{
+		ws:  ws,
+		act: activityFromRequest(ws.Request()),
+	}
+}
+
+func (self *xnetTransport) Request() *http.Request {
+	return self.ws.Request()
+}
+
+func (self *xnetTransport) Subprotocol() string {
+	if protocols := self.ws.Config().Protocol; len(protocols) == 1 {
+		return protocols[0]
+	}
+	return ``
+}
+
+func (self *xnetTransport) ReadMessage() ([]byte, error) {
+	var buf []byte
+	err := websocket.Message.Receive(self.ws, &buf)
+	if err == websocket.ErrFrameTooLarge {
+		return nil, ErrMessageTooLarge
+	}
+	return buf, err
+}
+
+func (self *xnetTransport) WriteMessage(buf []byte, binary bool) error {
+	self.ws.PayloadType = websocket.TextFrame
+	if binary {
+		self.ws.PayloadType = websocket.BinaryFrame
+	}
+	_, err := self.ws.Write(buf)
+	return err
+}
+
+func (self *xnetTransport) Ping() error {
+	return pingCodec.Send(self.ws, nil)
+}
+
+func (self *xnetTransport) LastRead() (time.Time, bool) {
+	if self.act == nil {
+		return time.Time{}, false
+	}
+	return self.act.LastRead(), true
+}
+
+func (self *xnetTransport) SetReadDeadline(t time.Time) error {
+	return self.ws.SetReadDeadline(t)
+}
+
+func (self *xnetTransport) SetWriteDeadline(t time.Time) error {
+	return self.ws.SetWriteDeadline(t)
+}
+
+func (self *xnetTransport) Close(code int, reason string) error {
+	// ws.Close always sends 1000, so close frame is written by hand when hijacked conn is known
+	if self.act == nil || self.act.conn == nil {
+		return self.ws.Close()
+	}
+	closeCodec.Send(self.ws, closeFrame{code, reason})
+	return self.act.conn.Close()
+}
@@ -0,0 +1,73 @@
+package apiserver
+
+import (
+	"context"
+	"reflect"
+)
+
+// Registrar is implemented by Router and by middleware chains returned from Router.With
+type Registrar interface {
+	IRouter
+	registerHandler(version int, command string, h *handler)
+}
+
+// TypedConn is Conn with statically typed session
+type TypedConn[S any] struct {
+	Conn
+}
+
+// Session returns zero S if session is not set or has other type
+func (self TypedConn[S]) Session() S {
+	sess, _ := self.Conn.Session().(S)
+	return sess
+}
+
+func (self TypedConn[S]) SetSession(v S) {
+	self.Conn.SetSession(v)
+}
+
+// Handle registers fn as command handler without per call reflection,
+// wrong handler signatures are compile errors here unlike RegisterApiHandler
+func Handle[Req any, Resp CmdNamer](router Registrar, version int, command string, fn func(ctx context.Context, conn Conn, req *Req) (Resp, error)) {
+	router.registerHandler(version, command, newTypedHandler(fn))
+}
+
+// HandleSession is Handle for handlers working with session of type S
+func HandleSession[S any, Req any, Resp CmdNamer](router Registrar, version int, command string, fn func(ctx context.Context, conn TypedConn[S], req *Req) (Resp, error)) {
+	router.registerHandler(version, command, newTypedHandler(func(ctx context.Context, conn Conn, req *Req) (Resp, error) {
+		return fn(ctx, TypedConn[S]{conn}, req)
+	}))
+}
+
+func newTypedHandler[Req any, Resp CmdNamer](fn func(ctx context.Context, conn Conn, req *Req) (Resp, error)) *handler {
+	h := new(handler)
+	h.WithContext = true
+	h.Input, h.InputPtr = reflect.TypeOf((*Req)(nil)).Elem(), true
+	h.validator = newValidator(h.Input)
+	respType := reflect.TypeOf((*Resp)(nil)).Elem()
+	respIsPtr := respType.Kind() == reflect.Ptr
+	outType, _ := ptrType(respType)
+	h.Output = []handlerOut{{typ: outType}}
+	h.typedCall = func(ctx context.Context, conn Conn, data []byte) ([]CmdNamer, error) {
+		req := new(Req)
+		if err := h.decode(ctx, conn, data, req); err != nil {
+			return decodeFailed(err)
+		}
+		resp, err := fn(ctx, conn, req)
+		out := make([]CmdNamer, 0, 2)
+		var zero Resp
+		// nil pointer replies are skipped like in reflective handlers
+		if !respIsPtr || CmdNamer(resp) != CmdNamer(zero) {
+			out = append(out, resp)
+		}
+		if err != nil {
+			errCmd, retErr := splitError(err)
+			if errCmd != nil {
+				out = append(out, errCmd)
+			}
+			return out, retErr
+		}
+		return out, nil
+	}
+	return h
+}
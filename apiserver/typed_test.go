@@ -0,0 +1,71 @@
+package apiserver_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/x12tech/go-websocketapi/apiserver"
+)
+
+type counterSession struct {
+	calls int
+}
+
+var _ = Describe("typed handlers", func() {
+	var (
+		router *apiserver.Router
+		conn   *apiserver.FakeConn
+	)
+	BeforeEach(func() {
+		router = apiserver.NewRouter()
+		conn = apiserver.NewFakeConn()
+	})
+	var Written = func() string {
+		conn.Mu.Lock()
+		defer conn.Mu.Unlock()
+		return string(conn.Written[len(conn.Written)-1])
+	}
+	It(`handles typed request and reply`, func() {
+		apiserver.Handle(router, 0, `echo`, func(ctx context.Context, conn apiserver.Conn, req *testEchoRequest) (*testEchoResponce, error) {
+			return &testEchoResponce{Pong: req.Ping}, nil
+		})
+		router.ProcessPacket(conn, []byte(`{ "cid": 1, "cmds":[{  "name" : "echo", "data" : {"ping" : "test"} }]}`))
+		Expect(Written()).To(MatchJSON(`{ "cid" : 1, "cmds": [{ "name": "test_echo_responce", "data" : { "pong" : "test" } }]}`))
+	})
+	It(`skips nil reply and sends ApiError`, func() {
+		apiserver.Handle(router, 0, `echo`, func(ctx context.Context, conn apiserver.Conn, req *testEchoRequest) (*testEchoResponce, error) {
+			return nil, apiserver.ApiError(`errtype`, `descr`)
+		})
+		router.ProcessPacket(conn, []byte(`{ "cid": 1, "cmds":[{  "name" : "echo", "data" : {} }]}`))
+		Expect(Written()).To(MatchJSON(`{ "cid" : 1, "cmds": [{  "name" : "Error", "data" : { "type" : "errtype", "msg" : "descr"} }]}`))
+	})
+	It(`gives typed session`, func() {
+		conn.SetSession(&counterSession{})
+		apiserver.HandleSession(router, 0, `count`, func(ctx context.Context, conn apiserver.TypedConn[*counterSession], req *struct{}) (testEchoResponce, error) {
+			conn.Session().calls++
+			return testEchoResponce{Pong: `counted`}, nil
+		})
+		router.ProcessPacket(conn, []byte(`{ "cid": 1, "cmds":[{  "name" : "count", "data" : {} }, {  "name" : "count", "data" : {} }]}`))
+		Expect(conn.Session()).To(Equal(&counterSession{calls: 2}))
+	})
+	It(`applies middleware`, func() {
+		apiserver.Handle(router.With(func(conn apiserver.Conn) ([]apiserver.CmdNamer, bool) {
+			return []apiserver.CmdNamer{apiserver.ApiError(`errtype`, `descr`)}, false
+		}), 0, `echo`, func(ctx context.Context, conn apiserver.Conn, req *testEchoRequest) (*testEchoResponce, error) {
+			return &testEchoResponce{Pong: req.Ping}, nil
+		})
+		router.ProcessPacket(conn, []byte(`{ "cid": 1, "cmds":[{  "name" : "echo", "data" : {"ping" : "test"} }]}`))
+		Expect(Written()).To(MatchJSON(`{ "cid" : 1, "cmds": [{  "name" : "Error", "data" : { "type" : "errtype", "msg" : "descr"} }]}`))
+	})
+	It(`is described like reflective handlers`, func() {
+		apiserver.Handle(router, 0, `echo`, func(ctx context.Context, conn apiserver.Conn, req *testEchoRequest) (*testEchoResponce, error) {
+			return nil, nil
+		})
+		scmds, ccmds := router.DescribeApi(nil)
+		Expect(scmds).To(HaveLen(1))
+		Expect(scmds[0].ReplayCommands).To(Equal([]string{`test_echo_responce`}))
+		Expect(scmds[0].Params).To(Equal(map[string]interface{}{`ping`: `string`}))
+		Expect(ccmds).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,220 @@
+package apiserver
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// FieldError describes a field of command data which failed validation
+type FieldError struct {
+	Field string `json:"field"`
+	Rule  string `json:"rule"`
+	Msg   string `json:"msg"`
+}
+
+// validateTag holds comma separated rules of a field, like `validate:"required,min=1,max=64"`.
+// Supported rules are required, min, max, len and oneof, min/max/len limit length of strings,
+// slices and maps and value of numbers, oneof options are separated by space.
+const validateTag = `validate`
+
+type rule struct {
+	tag   string
+	check func(v reflect.Value) bool
+	msg   string
+}
+
+type fieldValidator struct {
+	index  int
+	name   string
+	rules  []rule
+	nested *structValidator
+}
+
+// structValidator checks struct fields by their validate tags, nested structs and slices of them included
+type structValidator struct {
+	fields []fieldValidator
+}
+
+// newValidator returns nil when t has no validate tags, so such input is not walked at all
+func newValidator(t reflect.Type) *structValidator {
+	return buildValidator(t, make(map[reflect.Type]struct{}))
+}
+
+func buildValidator(t reflect.Type, visiting map[reflect.Type]struct{}) *structValidator {
+	if t == nil {
+		return nil
+	}
+	t, _ = ptrType(t)
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	if _, ok := visiting[t]; ok {
+		return nil
+	}
+	visiting[t] = struct{}{}
+	defer delete(visiting, t)
+	self := &structValidator{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _ := getFiledName(f)
+		if name == `` || name == `-` {
+			continue
+		}
+		fv := fieldValidator{
+			index: i,
+			name:  name,
+			rules: parseRules(t, f),
+		}
+		elem, _ := ptrType(f.Type)
+		if elem.Kind() == reflect.Slice || elem.Kind() == reflect.Array {
+			elem = elem.Elem()
+		}
+		fv.nested = buildValidator(elem, visiting)
+		if len(fv.rules) > 0 || fv.nested != nil {
+			self.fields = append(self.fields, fv)
+		}
+	}
+	if len(self.fields) == 0 {
+		return nil
+	}
+	return self
+}
+
+func parseRules(t reflect.Type, f reflect.StructField) []rule {
+	tag := f.Tag.Get(validateTag)
+	if tag == `` {
+		return nil
+	}
+	typ, _ := ptrType(f.Type)
+	rules := make([]rule, 0, 2)
+	for _, r := range strings.Split(tag, `,`) {
+		name, param := r, ``
+		if i := strings.Index(r, `=`); i >= 0 {
+			name, param = r[:i], r[i+1:]
+		}
+		switch name {
+		case `required`:
+			rules = append(rules, rule{r, isSet, `is required`})
+		case `min`, `max`, `len`:
+			limit, err := strconv.ParseFloat(param, 64)
+			if err != nil {
+				panic(t.String() + `.` + f.Name + `: ` + name + ` needs numeric parameter`)
+			}
+			rules = append(rules, sizeRule(t, f, typ, r, name, limit))
+		case `oneof`:
+			options := strings.Fields(param)
+			rules = append(rules, rule{r, func(v reflect.Value) bool {
+				s := fmt.Sprint(v.Interface())
+				for _, o := range options {
+					if s == o {
+						return true
+					}
+				}
+				return false
+			}, `must be one of ` + param})
+		default:
+			panic(t.String() + `.` + f.Name + `: unknown validate rule ` + name)
+		}
+	}
+	return rules
+}
+
+func sizeRule(t reflect.Type, f reflect.StructField, typ reflect.Type, tag, name string, limit float64) rule {
+	var size func(v reflect.Value) float64
+	what := `length`
+	switch typ.Kind() {
+	case reflect.String:
+		size = func(v reflect.Value) float64 { return float64(utf8.RuneCountInString(v.String())) }
+	case reflect.Slice, reflect.Array, reflect.Map:
+		size = func(v reflect.Value) float64 { return float64(v.Len()) }
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		size = func(v reflect.Value) float64 { return float64(v.Int()) }
+		what = `value`
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		size = func(v reflect.Value) float64 { return float64(v.Uint()) }
+		what = `value`
+	case reflect.Float32, reflect.Float64:
+		size = func(v reflect.Value) float64 { return v.Float() }
+		what = `value`
+	default:
+		panic(t.String() + `.` + f.Name + `: ` + name + ` is not applicable to ` + typ.String())
+	}
+	limitStr := strconv.FormatFloat(limit, 'f', -1, 64)
+	switch name {
+	case `min`:
+		return rule{tag, func(v reflect.Value) bool { return size(v) >= limit }, what + ` must be at least ` + limitStr}
+	case `max`:
+		return rule{tag, func(v reflect.Value) bool { return size(v) <= limit }, what + ` must be at most ` + limitStr}
+	}
+	return rule{tag, func(v reflect.Value) bool { return size(v) == limit }, what + ` must be ` + limitStr}
+}
+
+func isSet(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return !v.IsNil()
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() > 0
+	}
+	return !v.IsZero()
+}
+
+// Validate returns validation_error listing every failing field, nil if v is valid
+func (self *structValidator) Validate(v interface{}) *ErrorCommand {
+	var errs []FieldError
+	self.validate(reflect.ValueOf(v), ``, &errs)
+	if len(errs) == 0 {
+		return nil
+	}
+	fields := make([]string, 0, len(errs))
+	for _, e := range errs {
+		fields = append(fields, e.Field)
+	}
+	errCmd := ApiError(`validation_error`, `invalid fields: `+strings.Join(fields, `, `))
+	errCmd.Fields = errs
+	return errCmd
+}
+
+func (self *structValidator) validate(v reflect.Value, prefix string, errs *[]FieldError) {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	for _, fv := range self.fields {
+		path := prefix + fv.name
+		value := v.Field(fv.index)
+		absent := value.Kind() == reflect.Ptr && value.IsNil()
+		elem := reflect.Indirect(value)
+		for _, r := range fv.rules {
+			// required checks pointer itself, other rules check what it points to
+			checked := value
+			if r.tag != `required` {
+				// absent optional field is not checked
+				if absent {
+					continue
+				}
+				checked = elem
+			}
+			if !r.check(checked) {
+				*errs = append(*errs, FieldError{Field: path, Rule: r.tag, Msg: r.msg})
+				break
+			}
+		}
+		if fv.nested == nil {
+			continue
+		}
+		switch elem.Kind() {
+		case reflect.Slice, reflect.Array:
+			for i := 0; i < elem.Len(); i++ {
+				fv.nested.validate(elem.Index(i), path+`[`+strconv.Itoa(i)+`].`, errs)
+			}
+		case reflect.Struct:
+			fv.nested.validate(elem, path+`.`, errs)
+		}
+	}
+}
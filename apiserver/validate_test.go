@@ -0,0 +1,118 @@
+package apiserver_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/x12tech/go-websocketapi/apiserver"
+)
+
+type testItem struct {
+	Name  string `json:"name" validate:"required,max=8"`
+	Count int    `json:"count" validate:"min=1,max=10"`
+}
+
+type testOrderRequest struct {
+	Title string      `json:"title" validate:"required,min=1,max=64"`
+	Kind  string      `json:"kind" validate:"oneof=buy sell"`
+	Note  *string     `json:"note,omitempty" validate:"max=4"`
+	Items []*testItem `json:"items" validate:"min=1"`
+}
+
+var _ = Describe("validation", func() {
+	var (
+		router *apiserver.Router
+		conn   *apiserver.FakeConn
+		called bool
+	)
+	BeforeEach(func() {
+		router = apiserver.NewRouter()
+		conn = apiserver.NewFakeConn()
+		called = false
+		router.RegisterApiHandler(0, `order`, func(conn apiserver.Conn, req *testOrderRequest) error {
+			called = true
+			return nil
+		})
+	})
+	var Written = func() string {
+		conn.Mu.Lock()
+		defer conn.Mu.Unlock()
+		return string(conn.Written[len(conn.Written)-1])
+	}
+	It(`calls handler with valid input`, func() {
+		router.ProcessPacket(conn, []byte(`{ "cid": 1, "cmds":[{ "name" : "order", "data" : {
+			"title" : "order", "kind" : "buy", "items" : [{ "name" : "apple", "count" : 2 }]
+		} }]}`))
+		Expect(Written()).To(MatchJSON(`{ "cid": 1, "cmds": null}`))
+		Expect(called).To(BeTrue())
+	})
+	It(`lists every failing field`, func() {
+		router.ProcessPacket(conn, []byte(`{ "cid": 1, "cmds":[{ "name" : "order", "data" : {
+			"title" : "", "kind" : "hold", "note" : "too long", "items" : [{ "name" : "apple", "count" : 2 }, { "name" : "", "count" : 11 }]
+		} }]}`))
+		Expect(called).To(BeFalse())
+		Expect(Written()).To(MatchJSON(`{ "cid": 1, "cmds":[{ "name" : "Error", "data" : {
+			"type" : "validation_error",
+			"msg" : "invalid fields: title, kind, note, items[1].name, items[1].count",
+			"fields" : [
+				{ "field" : "title", "rule" : "required", "msg" : "is required" },
+				{ "field" : "kind", "rule" : "oneof=buy sell", "msg" : "must be one of buy sell" },
+				{ "field" : "note", "rule" : "max=4", "msg" : "length must be at most 4" },
+				{ "field" : "items[1].name", "rule" : "required", "msg" : "is required" },
+				{ "field" : "items[1].count", "rule" : "max=10", "msg" : "value must be at most 10" }
+			]
+		} }]}`))
+	})
+	It(`validates input of typed handlers`, func() {
+		apiserver.Handle(router, 0, `typed`, func(ctx context.Context, conn apiserver.Conn, req *testOrderRequest) (*testEchoResponce, error) {
+			called = true
+			return nil, nil
+		})
+		router.ProcessPacket(conn, []byte(`{ "cid": 1, "cmds":[{ "name" : "typed", "data" : { "title" : "order", "kind" : "sell" } }]}`))
+		Expect(called).To(BeFalse())
+		Expect(Written()).To(ContainSubstring(`"field":"items","rule":"min=1"`))
+	})
+	It(`checks required pointer wherever it is in the tag`, func() {
+		router.RegisterApiHandler(0, `limits`, func(conn apiserver.Conn, req *struct {
+			Before *int `json:"before" validate:"required,min=0"`
+			After  *int `json:"after" validate:"min=0,required"`
+		}) error {
+			called = true
+			return nil
+		})
+		router.ProcessPacket(conn, []byte(`{ "cid": 1, "cmds":[{ "name" : "limits", "data" : { "before" : 0, "after" : 0 } }]}`))
+		Expect(called).To(BeTrue())
+		router.ProcessPacket(conn, []byte(`{ "cid": 2, "cmds":[{ "name" : "limits", "data" : {} }]}`))
+		Expect(Written()).To(ContainSubstring(`invalid fields: before, after`))
+	})
+	It(`panics on unknown rule at registration`, func() {
+		Expect(func() {
+			router.RegisterApiHandler(0, `broken`, func(conn apiserver.Conn, req *struct {
+				Name string `validate:"email"`
+			}) error {
+				return nil
+			})
+		}).To(PanicWith(ContainSubstring(`unknown validate rule email`)))
+	})
+	It(`describes constraints`, func() {
+		scmds, _ := router.DescribeApi(nil)
+		Expect(scmds).To(HaveLen(1))
+		params := scmds[0].Params.(map[string]interface{})
+		keys := make([]string, 0, len(params))
+		for k := range params {
+			keys = append(keys, k)
+		}
+		Expect(keys).To(ConsistOf(`title`, `kind`, `note?`, `items`))
+		items := params[`items`].([]interface{})
+		Expect(items[0]).To(HaveKey(`name`))
+		Expect(scmds[0].Constraints).To(Equal(map[string]string{
+			`title`:         `required,min=1,max=64`,
+			`kind`:          `oneof=buy sell`,
+			`note`:          `max=4`,
+			`items`:         `min=1`,
+			`items[].name`:  `required,max=8`,
+			`items[].count`: `min=1,max=10`,
+		}))
+	})
+})
@@ -0,0 +1,85 @@
+package apiserver
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const HelloCommandName = `Hello`
+
+// HelloRequest declares highest API version client speaks and optionally lowest one
+type HelloRequest struct {
+	Version    int `json:"version"`
+	MinVersion int `json:"minVersion,omitempty"`
+}
+
+// HelloCommand reports negotiated API version and range supported by server
+type HelloCommand struct {
+	Version    int `json:"version"`
+	MinVersion int `json:"minVersion"`
+	MaxVersion int `json:"maxVersion"`
+}
+
+func (HelloCommand) CmdName() string {
+	return HelloCommandName
+}
+
+type versionRange struct {
+	min int
+	max int
+}
+
+// EnableVersionNegotiation registers Hello command, which stores on connection API version
+// negotiated within [min, max]. Upgrade request may also negotiate it with version query parameter.
+func (self *Router) EnableVersionNegotiation(min, max int) {
+	self.versions = &versionRange{min: min, max: max}
+	self.RegisterApiHandler(0, HelloCommandName, self.handleHello)
+}
+
+// Negotiate picks highest version supported both by client and server
+func (self *Router) Negotiate(clientMin, clientMax int) (int, error) {
+	if self.versions == nil {
+		return 0, errors.New(`version negotiation is not enabled`)
+	}
+	version := clientMax
+	if version > self.versions.max {
+		version = self.versions.max
+	}
+	if version < self.versions.min || version < clientMin {
+		return 0, ApiError(`unsupported_version`, `supported versions are `+
+			strconv.Itoa(self.versions.min)+`..`+strconv.Itoa(self.versions.max))
+	}
+	return version, nil
+}
+
+func (self *Router) handleHello(conn Conn, req *HelloRequest) (*HelloCommand, error) {
+	version, err := self.Negotiate(req.MinVersion, req.Version)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetVersion(version)
+	return &HelloCommand{
+		Version:    version,
+		MinVersion: self.versions.min,
+		MaxVersion: self.versions.max,
+	}, nil
+}
+
+// queryVersion negotiates version given in upgrade request query, ok is false if there is none
+func (self *Router) queryVersion(req *http.Request) (version int, ok bool, err error) {
+	param := req.URL.Query().Get(`version`)
+	if param == `` || self.versions == nil {
+		return 0, false, nil
+	}
+	clientVersion, err := strconv.Atoi(param)
+	if err != nil {
+		return 0, false, errors.Wrap(err, `bad version`)
+	}
+	version, err = self.Negotiate(0, clientVersion)
+	if err != nil {
+		return 0, false, err
+	}
+	return version, true, nil
+}
@@ -0,0 +1,74 @@
+package apiserver_test
+
+import (
+	"context"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/x12tech/go-websocketapi/apiserver"
+	"golang.org/x/net/websocket"
+)
+
+var _ = Describe("versions", func() {
+	var (
+		router *apiserver.Router
+		conn   *apiserver.FakeConn
+	)
+	BeforeEach(func() {
+		router = apiserver.NewRouter()
+		router.EnableVersionNegotiation(0, 2)
+		router.RegisterApiHandler(0, `cmdname`, func(conn apiserver.Conn) (*testEchoResponce, error) {
+			return &testEchoResponce{Pong: `v0`}, nil
+		})
+		router.RegisterApiHandler(2, `cmdname`, func(conn apiserver.Conn) (*testEchoResponce, error) {
+			return &testEchoResponce{Pong: `v2`}, nil
+		})
+		conn = apiserver.NewFakeConn()
+	})
+	var Written = func() string {
+		conn.Mu.Lock()
+		defer conn.Mu.Unlock()
+		return string(conn.Written[len(conn.Written)-1])
+	}
+	It(`uses version 0 until negotiated`, func() {
+		router.ProcessPacket(conn, []byte(`{ "cid": 1, "cmds":[{  "name" : "cmdname" }]}`))
+		Expect(Written()).To(MatchJSON(`{ "cid" : 1, "cmds": [{ "name": "test_echo_responce", "data" : { "pong" : "v0" } }]}`))
+	})
+	It(`negotiates version with Hello`, func() {
+		router.ProcessPacket(conn, []byte(`{ "cid": 1, "cmds":[{  "name" : "Hello", "data" : { "version" : 1 } }]}`))
+		Expect(Written()).To(MatchJSON(`{ "cid" : 1, "cmds": [{ "name": "Hello", "data" : { "version" : 1, "minVersion" : 0, "maxVersion" : 2 } }]}`))
+		router.ProcessPacket(conn, []byte(`{ "cid": 2, "cmds":[{  "name" : "cmdname" }]}`))
+		Expect(Written()).To(MatchJSON(`{ "cid" : 2, "cmds": [{ "name": "test_echo_responce", "data" : { "pong" : "v0" } }]}`))
+
+		router.ProcessPacket(conn, []byte(`{ "cid": 3, "cmds":[{  "name" : "Hello", "data" : { "version" : 5 } }, {  "name" : "cmdname" }]}`))
+		Expect(Written()).To(MatchJSON(`{ "cid" : 3, "cmds": [
+			{ "name": "Hello", "data" : { "version" : 2, "minVersion" : 0, "maxVersion" : 2 } },
+			{ "name": "test_echo_responce", "data" : { "pong" : "v2" } }
+		]}`))
+	})
+	It(`rejects unsupported versions`, func() {
+		router.ProcessPacket(conn, []byte(`{ "cid": 1, "cmds":[{  "name" : "Hello", "data" : { "version" : 4, "minVersion" : 3 } }]}`))
+		Expect(Written()).To(MatchJSON(`{ "cid" : 1, "cmds": [{ "name": "Error", "data" : { "type" : "unsupported_version", "msg" : "supported versions are 0..2" } }]}`))
+		Expect(conn.Version()).To(Equal(0))
+	})
+	It(`honours version argument of ProcessCommand`, func() {
+		res := router.ProcessCommand(conn, 2, `cmdname`, nil)
+		Expect(res).To(Equal([]apiserver.CommandOut{{Name: `test_echo_responce`, Data: &testEchoResponce{Pong: `v2`}}}))
+	})
+	It(`negotiates version with upgrade query`, func() {
+		_, httpserver, port := startServer(apiserver.ServerOpts{Router: router})
+		defer httpserver.Shutdown(context.Background())
+		addr := `ws://127.0.0.1:` + strconv.Itoa(port) + `/`
+
+		_, err := websocket.Dial(addr+`?version=bad`, ``, `http://127.0.0.1/`)
+		Expect(err).To(HaveOccurred())
+
+		ws, err := websocket.Dial(addr+`?version=7`, ``, `http://127.0.0.1/`)
+		Expect(err).To(Succeed())
+		defer ws.Close()
+		c := &ApiClient{ws}
+		Expect(c.Send([]byte(`{ "cid": 1, "cmds":[{  "name" : "cmdname" }]}`))).To(Succeed())
+		Expect(c.Await()).To(MatchJSON(`{ "cid" : 1, "cmds": [{ "name": "test_echo_responce", "data" : { "pong" : "v2" } }]}`))
+	})
+})
@@ -0,0 +1,445 @@
+// Package client calls commands of apiserver and receives its pushes, falling back to Server-Sent Events
+// or long-poll when websocket upgrade is refused
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/x12tech/go-websocketapi/apiserver"
+)
+
+var (
+	ErrClosed = errors.New(`client closed`)
+	// ErrConnectionLost fails calls in flight when connection drops, unless ReconnectOpts.RetryCalls is set
+	ErrConnectionLost = errors.New(`connection lost`)
+)
+
+const (
+	DefaultCallTimeout = 30 * time.Second
+	DefaultDialTimeout = 10 * time.Second
+	// DefaultMaxMessageSize matches limit server puts on incoming messages by default
+	DefaultMaxMessageSize = 32 << 20
+)
+
+type Logger interface {
+	Println(v ...interface{})
+}
+
+type Options struct {
+	// Header is sent with websocket upgrade and fallback requests
+	Header http.Header
+	// Compression negotiates permessage-deflate with server supporting it
+	Compression bool
+	// Fallback makes dialing try Server-Sent Events and then long-poll when websocket cannot be established
+	Fallback bool
+	// HTTPClient makes fallback requests, http.DefaultClient if nil
+	HTTPClient *http.Client
+	// CallTimeout bounds Call whose context has no deadline, DefaultCallTimeout if zero
+	CallTimeout time.Duration
+	// DialTimeout bounds dialing whose context has no deadline, DefaultDialTimeout if zero
+	DialTimeout time.Duration
+	// MaxMessageSize limits size of packet read from websocket or stream in bytes, DefaultMaxMessageSize if zero
+	MaxMessageSize int
+	// Reconnect redials lost connection, client is closed with connection if nil
+	Reconnect *ReconnectOpts
+	Logger    Logger
+}
+
+// Command is a command received from server, its data is left JSON encoded
+type Command struct {
+	Name string          `json:"name"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type packet struct {
+	Commands []Command `json:"cmds"`
+	Cid      int32     `json:"cid,omitempty"`
+}
+
+type reply struct {
+	cmds []Command
+	err  error
+}
+
+// call is waiting for reply
+type call struct {
+	// seq orders calls as they were made, unlike cid it does not wrap around
+	seq   uint64
+	buf   []byte
+	reply chan reply
+	// resume calls are made by Resume and OnReconnect hooks, they are never retried
+	resume bool
+}
+
+type Client struct {
+	opts Options
+	dial func(ctx context.Context) (transport, error)
+	// transport is nil while reconnecting, ready is closed when it may be used by calls
+	transport transport
+	ready     chan struct{}
+	lastCid   int32
+	mu        sync.Mutex
+	lastSeq   uint64
+	pending   map[int32]*call
+	handlers  map[string]func(data json.RawMessage)
+	hooks     []func(ctx context.Context) error
+	done      chan struct{}
+	err       error
+	closeOnce sync.Once
+}
+
+// Dial connects to apiserver.Server at url with ws or http scheme
+func Dial(ctx context.Context, url string, opts Options) (*Client, error) {
+	opts = withDefaults(opts)
+	return connect(ctx, opts, func(ctx context.Context) (transport, error) {
+		return dialURL(ctx, url, opts)
+	})
+}
+
+// DialStream connects to apiserver.Server serving TCP or Unix socket listener
+func DialStream(ctx context.Context, network, address string, opts Options) (*Client, error) {
+	opts = withDefaults(opts)
+	return connect(ctx, opts, func(ctx context.Context) (transport, error) {
+		return dialStream(ctx, network, address, opts)
+	})
+}
+
+// Conn carries raw packets over whichever transport DialConn established
+type Conn struct {
+	transport transport
+}
+
+// DialConn connects to apiserver.Server at url with ws or http scheme
+func DialConn(ctx context.Context, url string, opts Options) (*Conn, error) {
+	opts = withDefaults(opts)
+	ctx, cancel := dialContext(ctx, opts)
+	defer cancel()
+	t, err := dialURL(ctx, url, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, `dial`)
+	}
+	return &Conn{transport: t}, nil
+}
+
+// ReadPacket returns next packet sent by server, *CloseError or io.EOF when connection is closed
+func (self *Conn) ReadPacket() ([]byte, error) {
+	return self.transport.ReadMessage()
+}
+
+func (self *Conn) WritePacket(ctx context.Context, buf []byte) error {
+	return self.transport.WriteMessage(ctx, buf)
+}
+
+func (self *Conn) Close() error {
+	return self.transport.Close()
+}
+
+// dialURL tries websocket first and then fallback transports if they are enabled
+func dialURL(ctx context.Context, url string, opts Options) (transport, error) {
+	t, err := dialWs(ctx, url, opts)
+	if err != nil && opts.Fallback {
+		opts.Logger.Println(`websocket failed, trying fallback:`, err)
+		for _, dial := range []func(context.Context, string, Options) (transport, error){dialSSE, dialPoll} {
+			if t, err = dial(ctx, url, opts); err == nil {
+				break
+			}
+			opts.Logger.Println(`fallback failed:`, err)
+		}
+	}
+	return t, err
+}
+
+type emptyLogger struct{}
+
+func (emptyLogger) Println(v ...interface{}) {}
+
+func withDefaults(opts Options) Options {
+	if opts.CallTimeout <= 0 {
+		opts.CallTimeout = DefaultCallTimeout
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = DefaultDialTimeout
+	}
+	if opts.MaxMessageSize <= 0 {
+		opts.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if opts.Logger == nil {
+		opts.Logger = emptyLogger{}
+	}
+	if opts.Reconnect != nil {
+		reconnect := opts.Reconnect.withDefaults()
+		opts.Reconnect = &reconnect
+	}
+	return opts
+}
+
+func dialContext(ctx context.Context, opts Options) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, opts.DialTimeout)
+}
+
+func connect(ctx context.Context, opts Options, dial func(ctx context.Context) (transport, error)) (*Client, error) {
+	dialCtx, cancel := dialContext(ctx, opts)
+	defer cancel()
+	t, err := dial(dialCtx)
+	if err != nil {
+		return nil, errors.Wrap(err, `dial`)
+	}
+	self := &Client{
+		opts:      opts,
+		dial:      dial,
+		transport: t,
+		ready:     make(chan struct{}),
+		pending:   make(map[int32]*call),
+		handlers:  make(map[string]func(data json.RawMessage)),
+		done:      make(chan struct{}),
+	}
+	close(self.ready)
+	go self.readLoop(t)
+	return self, nil
+}
+
+func (self *Client) readLoop(t transport) {
+	for {
+		buf, err := t.ReadMessage()
+		if err != nil {
+			self.lost(t, err)
+			return
+		}
+		var p packet
+		if err := json.Unmarshal(buf, &p); err != nil {
+			self.opts.Logger.Println(`cannot parse packet:`, err)
+			continue
+		}
+		if p.Cid != 0 {
+			self.mu.Lock()
+			c, ok := self.pending[p.Cid]
+			delete(self.pending, p.Cid)
+			self.mu.Unlock()
+			if !ok {
+				// call has given up waiting
+				self.opts.Logger.Println(`late reply dropped, cid:`, p.Cid)
+				continue
+			}
+			c.reply <- reply{cmds: p.Commands}
+			continue
+		}
+		self.dispatch(p.Commands)
+	}
+}
+
+// dispatch calls push handlers in order pushes arrive
+func (self *Client) dispatch(cmds []Command) {
+	for _, cmd := range cmds {
+		self.mu.Lock()
+		handler := self.handlers[cmd.Name]
+		self.mu.Unlock()
+		if handler == nil {
+			self.opts.Logger.Println(`unhandled push:`, cmd.Name)
+			continue
+		}
+		handler(cmd.Data)
+	}
+}
+
+// fail closes client with err and fails pending calls with it
+func (self *Client) fail(err error) {
+	self.closeOnce.Do(func() {
+		self.mu.Lock()
+		self.err = err
+		pending := self.pending
+		self.pending = make(map[int32]*call)
+		t := self.transport
+		self.mu.Unlock()
+		for _, c := range pending {
+			c.reply <- reply{err: err}
+		}
+		if t != nil {
+			t.Close()
+		}
+		close(self.done)
+	})
+}
+
+// OnPush registers handler of command pushed by server, it is called from the goroutine reading
+// connection, so it should not block on calls
+func (self *Client) OnPush(name string, handler func(data json.RawMessage)) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.handlers[name] = handler
+}
+
+// HandlePush registers handler of command named by CmdName of T
+func HandlePush[T any, PT interface {
+	*T
+	apiserver.CmdNamer
+}](c *Client, handler func(cmd PT)) {
+	c.OnPush(PT(new(T)).CmdName(), func(data json.RawMessage) {
+		cmd := PT(new(T))
+		if err := json.Unmarshal(data, cmd); err != nil {
+			c.opts.Logger.Println(`cannot decode push:`, err)
+			return
+		}
+		handler(cmd)
+	})
+}
+
+// Call sends command with req as data and decodes reply commands into resp by their CmdName.
+// Error reply is returned as *apiserver.ErrorCommand.
+func (self *Client) Call(ctx context.Context, command string, req interface{}, resp ...apiserver.CmdNamer) error {
+	cmds, err := self.CallRaw(ctx, command, req)
+	if err != nil {
+		return err
+	}
+	for _, r := range resp {
+		name := r.CmdName()
+		for _, cmd := range cmds {
+			if cmd.Name == name {
+				if err := json.Unmarshal(cmd.Data, r); err != nil {
+					return errors.Wrap(err, `decode `+name)
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// CallRaw returns reply commands as they are. While client reconnects calls wait for connection.
+func (self *Client) CallRaw(ctx context.Context, command string, req interface{}) ([]Command, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, self.opts.CallTimeout)
+		defer cancel()
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, errors.Wrap(err, `encode request`)
+	}
+	cid := self.nextCid()
+	buf, err := json.Marshal(apiserver.PacketIn{
+		Cid:      cid,
+		Commands: []apiserver.CommandIn{{Name: command, Data: data}},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, `encode packet`)
+	}
+	c := &call{
+		buf:    buf,
+		reply:  make(chan reply, 1),
+		resume: isResume(ctx),
+	}
+	t, err := self.register(ctx, cid, c)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		self.mu.Lock()
+		delete(self.pending, cid)
+		self.mu.Unlock()
+	}()
+	if err := t.WriteMessage(ctx, buf); err != nil {
+		if ctx.Err() != nil || self.opts.Reconnect == nil {
+			return nil, errors.Wrap(err, `send`)
+		}
+		// call is retried or failed once read loop notices the loss
+		t.Close()
+	}
+	select {
+	case r := <-c.reply:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return r.cmds, replyError(r.cmds)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// register adds pending call once connection is ready, calls of Resume do not wait for it
+func (self *Client) register(ctx context.Context, cid int32, c *call) (transport, error) {
+	for {
+		self.mu.Lock()
+		if self.err != nil {
+			self.mu.Unlock()
+			return nil, self.err
+		}
+		ready := self.ready
+		if isClosed(ready) || c.resume {
+			t := self.transport
+			if t == nil {
+				// lost again while resuming
+				self.mu.Unlock()
+				return nil, ErrConnectionLost
+			}
+			self.lastSeq++
+			c.seq = self.lastSeq
+			self.pending[cid] = c
+			self.mu.Unlock()
+			return t, nil
+		}
+		self.mu.Unlock()
+		select {
+		case <-ready:
+		case <-self.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func replyError(cmds []Command) error {
+	for _, cmd := range cmds {
+		if cmd.Name == (apiserver.ErrorCommand{}).CmdName() {
+			errCmd := new(apiserver.ErrorCommand)
+			if err := json.Unmarshal(cmd.Data, errCmd); err != nil {
+				return errors.Wrap(err, `decode error`)
+			}
+			return errCmd
+		}
+	}
+	return nil
+}
+
+// nextCid skips zero, as reply without cid is a push
+func (self *Client) nextCid() int32 {
+	for {
+		if cid := atomic.AddInt32(&self.lastCid, 1); cid != 0 {
+			return cid
+		}
+	}
+}
+
+// Done is closed when client is closed
+func (self *Client) Done() <-chan struct{} {
+	return self.done
+}
+
+// Err tells why client was closed, *CloseError if server closed connection, ErrClosed after Close
+func (self *Client) Err() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.err
+}
+
+func (self *Client) Close() error {
+	self.fail(ErrClosed)
+	return nil
+}
@@ -0,0 +1,415 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	"github.com/x12tech/go-websocketapi/apiserver"
+	"github.com/x12tech/go-websocketapi/client"
+)
+
+type loginRequest struct {
+	Key string `json:"key"`
+}
+
+type loginResponse struct {
+	Key     string `json:"key"`
+	Resumed bool   `json:"resumed"`
+}
+
+func (loginResponse) CmdName() string {
+	return `login_response`
+}
+
+// dropListener lets test break connections, hijacked ones included
+type dropListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (self *dropListener) Accept() (net.Conn, error) {
+	conn, err := self.Listener.Accept()
+	if err == nil {
+		self.mu.Lock()
+		self.conns = append(self.conns, conn)
+		self.mu.Unlock()
+	}
+	return conn, err
+}
+
+func (self *dropListener) Drop() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for _, conn := range self.conns {
+		conn.Close()
+	}
+	self.conns = nil
+}
+
+var _ = Describe("client", func() {
+	var (
+		router  *apiserver.Router
+		server  *apiserver.Server
+		ctx     context.Context
+		servers []*httptest.Server
+	)
+	BeforeEach(func() {
+		ctx = context.Background()
+		router = apiserver.NewRouter()
+		router.RegisterApiHandler(0, `echo`, func(conn apiserver.Conn, req *echoRequest) (*echoResponse, error) {
+			time.Sleep(time.Duration(req.Delay) * time.Millisecond)
+			conn.Send(notice{Text: `about ` + req.Ping})
+			return &echoResponse{Pong: req.Ping}, nil
+		})
+		router.RegisterApiHandler(0, `bye`, func(conn apiserver.Conn, req *echoRequest) error {
+			go conn.Close()
+			return nil
+		})
+		var err error
+		server, err = apiserver.NewServer(apiserver.ServerOpts{
+			Router:         router,
+			DispatchMode:   apiserver.DispatchUnordered,
+			EnableFallback: true,
+			PollTimeout:    100 * time.Millisecond,
+		})
+		Expect(err).To(Succeed())
+	})
+	AfterEach(func() {
+		for _, httpserver := range servers {
+			httpserver.Close()
+		}
+		servers = nil
+	})
+	serve := func(handler http.Handler) string {
+		httpserver := httptest.NewServer(handler)
+		servers = append(servers, httpserver)
+		return httpserver.URL
+	}
+	It(`matches replies to calls by cid`, func() {
+		c, err := client.Dial(ctx, serve(server), client.Options{})
+		Expect(err).To(Succeed())
+		defer c.Close()
+		var wg sync.WaitGroup
+		for i, delay := range []int{60, 30, 0} {
+			wg.Add(1)
+			go func(ping string, delay int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				var resp echoResponse
+				Expect(c.Call(ctx, `echo`, echoRequest{Ping: ping, Delay: delay}, &resp)).To(Succeed())
+				Expect(resp.Pong).To(Equal(ping))
+			}(string(rune('a'+i)), delay)
+		}
+		wg.Wait()
+	})
+	It(`routes pushes to handlers by name`, func() {
+		c, err := client.Dial(ctx, serve(server), client.Options{})
+		Expect(err).To(Succeed())
+		defer c.Close()
+		notices := make(chan string, 1)
+		client.HandlePush(c, func(n *notice) {
+			notices <- n.Text
+		})
+		Expect(c.Call(ctx, `echo`, echoRequest{Ping: `push`})).To(Succeed())
+		Eventually(notices).Should(Receive(Equal(`about push`)))
+		Expect(server.BroadcastAll(notice{Text: `everyone`})).To(Succeed())
+		Eventually(notices).Should(Receive(Equal(`everyone`)))
+	})
+	It(`returns Error reply as error`, func() {
+		c, err := client.Dial(ctx, serve(server), client.Options{})
+		Expect(err).To(Succeed())
+		defer c.Close()
+		err = c.Call(ctx, `unknown`, nil)
+		var errCmd *apiserver.ErrorCommand
+		Expect(errors.As(err, &errCmd)).To(BeTrue())
+		Expect(errCmd.Type).To(Equal(`command_handler_not_found`))
+	})
+	It(`times out calls`, func() {
+		c, err := client.Dial(ctx, serve(server), client.Options{CallTimeout: 20 * time.Millisecond})
+		Expect(err).To(Succeed())
+		defer c.Close()
+		Expect(c.Call(ctx, `echo`, echoRequest{Delay: 200})).To(Equal(context.DeadlineExceeded))
+	})
+	It(`drops replies of timed out calls`, func() {
+		c, err := client.Dial(ctx, serve(server), client.Options{CallTimeout: 20 * time.Millisecond})
+		Expect(err).To(Succeed())
+		defer c.Close()
+		notices := make(chan string, 1)
+		client.HandlePush(c, func(n *notice) {
+			notices <- n.Text
+		})
+		late := make(chan json.RawMessage, 1)
+		c.OnPush(`echo_response`, func(data json.RawMessage) {
+			late <- data
+		})
+		Expect(c.Call(ctx, `echo`, echoRequest{Ping: `late`, Delay: 100})).To(Equal(context.DeadlineExceeded))
+		Eventually(notices).Should(Receive(Equal(`about late`)))
+		// late reply follows its notice, so it is read before reply of the next call
+		Expect(c.Call(ctx, `echo`, echoRequest{Ping: `next`})).To(Succeed())
+		Expect(late).NotTo(Receive())
+	})
+	It(`tells why server closed connection`, func() {
+		c, err := client.Dial(ctx, serve(server), client.Options{})
+		Expect(err).To(Succeed())
+		defer c.Close()
+		c.Call(ctx, `bye`, nil)
+		Eventually(c.Done()).Should(BeClosed())
+		Expect(c.Err()).To(Equal(&client.CloseError{Code: apiserver.CloseNormal, Reason: apiserver.ErrClosedByServer.Error()}))
+		Expect(c.Call(ctx, `echo`, echoRequest{})).To(Equal(c.Err()))
+	})
+	It(`fails calls pending on close`, func() {
+		c, err := client.Dial(ctx, serve(server), client.Options{})
+		Expect(err).To(Succeed())
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			c.Close()
+		}()
+		Expect(c.Call(ctx, `echo`, echoRequest{Delay: 200})).To(Equal(client.ErrClosed))
+	})
+	for _, noStream := range []bool{false, true} {
+		noStream := noStream
+		name := `Server-Sent Events`
+		if noStream {
+			name = `long-poll`
+		}
+		It(`falls back to `+name+` when websocket is refused`, func() {
+			url := serve(noUpgrade(server, noStream))
+			_, err := client.Dial(ctx, url, client.Options{})
+			Expect(err).To(HaveOccurred())
+			c, err := client.Dial(ctx, url, client.Options{Fallback: true})
+			Expect(err).To(Succeed())
+			notices := make(chan string, 1)
+			client.HandlePush(c, func(n *notice) {
+				notices <- n.Text
+			})
+			var resp echoResponse
+			Expect(c.Call(ctx, `echo`, echoRequest{Ping: `fallback`}, &resp)).To(Succeed())
+			Expect(resp.Pong).To(Equal(`fallback`))
+			Eventually(notices).Should(Receive(Equal(`about fallback`)))
+			Eventually(server.Count).Should(Equal(1))
+			c.Close()
+			Eventually(server.Count).Should(Equal(0))
+		})
+	}
+	It(`dials stream listener`, func() {
+		l, err := net.Listen(`tcp`, `127.0.0.1:0`)
+		Expect(err).To(Succeed())
+		go server.Serve(l)
+		defer server.Shutdown(ctx)
+		c, err := client.DialStream(ctx, `tcp`, l.Addr().String(), client.Options{})
+		Expect(err).To(Succeed())
+		defer c.Close()
+		var resp echoResponse
+		Expect(c.Call(ctx, `echo`, echoRequest{Ping: `tcp`}, &resp)).To(Succeed())
+		Expect(resp.Pong).To(Equal(`tcp`))
+	})
+	It(`fails stream packet larger than limit`, func() {
+		l, err := net.Listen(`tcp`, `127.0.0.1:0`)
+		Expect(err).To(Succeed())
+		go server.Serve(l)
+		defer server.Shutdown(ctx)
+		c, err := client.DialStream(ctx, `tcp`, l.Addr().String(), client.Options{MaxMessageSize: 16})
+		Expect(err).To(Succeed())
+		defer c.Close()
+		var resp echoResponse
+		Expect(errors.Cause(c.Call(ctx, `echo`, echoRequest{Ping: `tcp`}, &resp))).To(Equal(apiserver.ErrMessageTooLarge))
+	})
+	Describe(`reconnect`, func() {
+		var (
+			httpserver *httptest.Server
+			listener   *dropListener
+			logins     chan string
+		)
+		BeforeEach(func() {
+			logins = make(chan string, 10)
+			router.RegisterApiHandler(0, `login`, func(conn apiserver.Conn, req *loginRequest) (*loginResponse, error) {
+				logins <- req.Key
+				resp := &loginResponse{Key: req.Key, Resumed: req.Key != ``}
+				if !resp.Resumed {
+					resp.Key = `key`
+				}
+				conn.SetSession(resp.Key)
+				return resp, nil
+			})
+			router.RegisterApiHandler(0, `whoami`, func(conn apiserver.Conn, req *echoRequest) (*loginResponse, error) {
+				key, _ := conn.Session().(string)
+				return &loginResponse{Key: key}, nil
+			})
+			httpserver = httptest.NewUnstartedServer(server)
+			listener = &dropListener{Listener: httpserver.Listener}
+			httpserver.Listener = listener
+			httpserver.Start()
+			servers = append(servers, httpserver)
+		})
+		dial := func(reconnect client.ReconnectOpts) *client.Client {
+			reconnect.MinBackoff = 10 * time.Millisecond
+			c, err := client.Dial(ctx, httpserver.URL, client.Options{Reconnect: &reconnect})
+			Expect(err).To(Succeed())
+			return c
+		}
+		It(`resumes session and runs hooks on new connection`, func() {
+			var key string
+			c := dial(client.ReconnectOpts{
+				Resume: func(ctx context.Context, c *client.Client) error {
+					var resp loginResponse
+					if err := c.Call(ctx, `login`, loginRequest{Key: key}, &resp); err != nil {
+						return err
+					}
+					if !resp.Resumed {
+						return errors.New(`not resumed`)
+					}
+					return nil
+				},
+			})
+			defer c.Close()
+			hooks := make(chan string, 1)
+			c.OnReconnect(func(ctx context.Context) error {
+				var resp loginResponse
+				err := c.Call(ctx, `whoami`, nil, &resp)
+				hooks <- resp.Key
+				return err
+			})
+			var resp loginResponse
+			Expect(c.Call(ctx, `login`, loginRequest{}, &resp)).To(Succeed())
+			key = resp.Key
+			Expect(logins).To(Receive(Equal(``)))
+
+			listener.Drop()
+			Eventually(logins).Should(Receive(Equal(`key`)))
+			Eventually(hooks).Should(Receive(Equal(`key`)))
+			Expect(c.Call(ctx, `whoami`, nil, &resp)).To(Succeed())
+			Expect(resp.Key).To(Equal(`key`))
+			Expect(c.Err()).To(BeNil())
+		})
+		It(`fails calls in flight with ErrConnectionLost`, func() {
+			c := dial(client.ReconnectOpts{})
+			defer c.Close()
+			go func() {
+				time.Sleep(30 * time.Millisecond)
+				listener.Drop()
+			}()
+			Expect(c.Call(ctx, `echo`, echoRequest{Delay: 200})).To(Equal(client.ErrConnectionLost))
+			var resp echoResponse
+			Expect(c.Call(ctx, `echo`, echoRequest{Ping: `again`}, &resp)).To(Succeed())
+			Expect(resp.Pong).To(Equal(`again`))
+		})
+		It(`retries calls in flight if asked`, func() {
+			c := dial(client.ReconnectOpts{RetryCalls: true})
+			defer c.Close()
+			go func() {
+				time.Sleep(30 * time.Millisecond)
+				listener.Drop()
+			}()
+			var resp echoResponse
+			Expect(c.Call(ctx, `echo`, echoRequest{Ping: `retried`, Delay: 200}, &resp)).To(Succeed())
+			Expect(resp.Pong).To(Equal(`retried`))
+		})
+		It(`retries calls in order they were made`, func() {
+			var (
+				mu      sync.Mutex
+				arrived []string
+			)
+			// the first packet holds sequential connection until it is dropped, retries are answered at once
+			router.RegisterApiHandler(0, `queue`, func(conn apiserver.Conn, req *echoRequest) (*echoResponse, error) {
+				mu.Lock()
+				arrived = append(arrived, req.Ping)
+				retried := len(arrived) > 1
+				mu.Unlock()
+				if !retried {
+					time.Sleep(200 * time.Millisecond)
+				}
+				return &echoResponse{Pong: req.Ping}, nil
+			})
+			seq, err := apiserver.NewServer(apiserver.ServerOpts{Router: router})
+			Expect(err).To(Succeed())
+			httpserver := httptest.NewUnstartedServer(seq)
+			listener := &dropListener{Listener: httpserver.Listener}
+			httpserver.Listener = listener
+			httpserver.Start()
+			servers = append(servers, httpserver)
+			c, err := client.Dial(ctx, httpserver.URL, client.Options{
+				Reconnect: &client.ReconnectOpts{RetryCalls: true, MinBackoff: 10 * time.Millisecond},
+			})
+			Expect(err).To(Succeed())
+			defer c.Close()
+			var wg sync.WaitGroup
+			for _, ping := range []string{`a`, `b`, `c`, `d`} {
+				wg.Add(1)
+				go func(ping string) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					Expect(c.Call(ctx, `queue`, echoRequest{Ping: ping})).To(Succeed())
+				}(ping)
+				// calls get increasing cids
+				time.Sleep(10 * time.Millisecond)
+			}
+			listener.Drop()
+			wg.Wait()
+			mu.Lock()
+			defer mu.Unlock()
+			Expect(arrived).To(Equal([]string{`a`, `a`, `b`, `c`, `d`}))
+		})
+		It(`redials until resume succeeds`, func() {
+			var attempts int32
+			c := dial(client.ReconnectOpts{
+				Resume: func(ctx context.Context, c *client.Client) error {
+					if atomic.AddInt32(&attempts, 1) < 3 {
+						return errors.New(`not yet`)
+					}
+					return c.Call(ctx, `login`, loginRequest{Key: `key`})
+				},
+			})
+			defer c.Close()
+			listener.Drop()
+			Eventually(logins).Should(Receive(Equal(`key`)))
+			Expect(atomic.LoadInt32(&attempts)).To(BeEquivalentTo(3))
+			Expect(c.Call(ctx, `echo`, echoRequest{})).To(Succeed())
+		})
+		It(`closes after MaxAttempts`, func() {
+			c := dial(client.ReconnectOpts{MaxAttempts: 2})
+			httpserver.Close()
+			listener.Drop()
+			Eventually(c.Done()).Should(BeClosed())
+			Expect(c.Err()).To(HaveOccurred())
+			Expect(c.Call(ctx, `echo`, echoRequest{})).To(Equal(c.Err()))
+		})
+		It(`reconnects connection closed by idle timeout`, func() {
+			idle, err := apiserver.NewServer(apiserver.ServerOpts{
+				Router:      router,
+				IdleTimeout: 50 * time.Millisecond,
+			})
+			Expect(err).To(Succeed())
+			reconnects := make(chan struct{}, 10)
+			c, err := client.Dial(ctx, serve(idle), client.Options{
+				Reconnect: &client.ReconnectOpts{MinBackoff: 10 * time.Millisecond},
+			})
+			Expect(err).To(Succeed())
+			defer c.Close()
+			c.OnReconnect(func(ctx context.Context) error {
+				reconnects <- struct{}{}
+				return nil
+			})
+			Eventually(reconnects).Should(Receive())
+			Expect(c.Err()).To(BeNil())
+			var resp echoResponse
+			Expect(c.Call(ctx, `echo`, echoRequest{Ping: `back`}, &resp)).To(Succeed())
+			Expect(resp.Pong).To(Equal(`back`))
+		})
+		It(`does not reconnect connection closed by server`, func() {
+			c := dial(client.ReconnectOpts{})
+			c.Call(ctx, `bye`, nil)
+			Eventually(c.Done()).Should(BeClosed())
+			Expect(c.Err()).To(Equal(&client.CloseError{Code: apiserver.CloseNormal, Reason: apiserver.ErrClosedByServer.Error()}))
+		})
+	})
+})
@@ -0,0 +1,169 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/x12tech/go-websocketapi/apiserver"
+	"github.com/x12tech/go-websocketapi/client"
+)
+
+type echoRequest struct {
+	Ping  string `json:"ping"`
+	Delay int    `json:"delay"`
+}
+
+type echoResponse struct {
+	Pong string `json:"pong"`
+}
+
+func (echoResponse) CmdName() string {
+	return `echo_response`
+}
+
+type notice struct {
+	Text string `json:"text"`
+}
+
+func (notice) CmdName() string {
+	return `Notice`
+}
+
+// noUpgrade plays proxy which breaks websocket upgrades, and event streams too if noStream is set
+func noUpgrade(handler http.Handler, noStream bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(`Upgrade`) != `` || noStream && strings.Contains(req.Header.Get(`Accept`), `text/event-stream`) {
+			http.Error(w, `forbidden by proxy`, http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+type rawPacket struct {
+	Commands []struct {
+		Name string          `json:"name"`
+		Data json.RawMessage `json:"data"`
+	} `json:"cmds"`
+	Cid int32 `json:"cid"`
+}
+
+var _ = Describe("conn", func() {
+	var (
+		server     *apiserver.Server
+		httpserver *httptest.Server
+		ctx        context.Context
+	)
+	BeforeEach(func() {
+		ctx = context.Background()
+		router := apiserver.NewRouter()
+		router.RegisterApiHandler(0, `echo`, func(conn apiserver.Conn, req *echoRequest) (*echoResponse, error) {
+			conn.Send(notice{Text: `about ` + req.Ping})
+			return &echoResponse{Pong: req.Ping}, nil
+		})
+		var err error
+		server, err = apiserver.NewServer(apiserver.ServerOpts{
+			Router:         router,
+			EnableFallback: true,
+			PollTimeout:    100 * time.Millisecond,
+		})
+		Expect(err).To(Succeed())
+	})
+	AfterEach(func() {
+		httpserver.Close()
+	})
+	// exchange sends echo and reads its reply and push in any order
+	exchange := func(conn *client.Conn) {
+		Expect(conn.WritePacket(ctx, []byte(`{"cid":7,"cmds":[{"name":"echo","data":{"ping":"hi"}}]}`))).To(Succeed())
+		names := make([]string, 0, 2)
+		for len(names) < 2 {
+			buf, err := conn.ReadPacket()
+			Expect(err).To(Succeed())
+			var p rawPacket
+			Expect(json.Unmarshal(buf, &p)).To(Succeed())
+			for _, cmd := range p.Commands {
+				if cmd.Name == `echo_response` {
+					Expect(p.Cid).To(BeEquivalentTo(7))
+				}
+				names = append(names, cmd.Name)
+			}
+		}
+		Expect(names).To(ConsistOf(`echo_response`, `Notice`))
+	}
+	It(`uses websocket when it is not refused`, func() {
+		httpserver = httptest.NewServer(server)
+		conn, err := client.DialConn(ctx, httpserver.URL, client.Options{Fallback: true})
+		Expect(err).To(Succeed())
+		defer conn.Close()
+		exchange(conn)
+		Expect(server.Count()).To(Equal(1))
+	})
+	for _, noStream := range []bool{false, true} {
+		noStream := noStream
+		name := `Server-Sent Events`
+		if noStream {
+			name = `long-poll`
+		}
+		It(`picks `+name+` when websocket is refused`, func() {
+			httpserver = httptest.NewServer(noUpgrade(server, noStream))
+			_, err := client.DialConn(ctx, httpserver.URL, client.Options{})
+			Expect(err).To(HaveOccurred())
+			conn, err := client.DialConn(ctx, httpserver.URL, client.Options{Fallback: true})
+			Expect(err).To(Succeed())
+			exchange(conn)
+			Eventually(server.Count).Should(Equal(1))
+			Expect(conn.Close()).To(Succeed())
+			Eventually(server.Count).Should(Equal(0))
+		})
+	}
+	It(`reopens broken event stream with token`, func() {
+		streams := make(chan context.CancelFunc, 2)
+		reopened := make(chan string, 1)
+		httpserver = httptest.NewServer(noUpgrade(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if strings.Contains(req.Header.Get(`Accept`), `text/event-stream`) {
+				if token := req.URL.Query().Get(`token`); token != `` {
+					reopened <- token
+				}
+				ctx, cancel := context.WithCancel(req.Context())
+				streams <- cancel
+				req = req.WithContext(ctx)
+			}
+			server.ServeHTTP(w, req)
+		}), false))
+		conn, err := client.DialConn(ctx, httpserver.URL, client.Options{Fallback: true})
+		Expect(err).To(Succeed())
+		defer conn.Close()
+		// proxy cuts the stream
+		(<-streams)()
+		exchange(conn)
+		Expect(reopened).To(Receive(Not(BeEmpty())))
+		Expect(server.Count()).To(Equal(1))
+	})
+	It(`bounds closing request by dial timeout`, func() {
+		hang := make(chan struct{})
+		defer close(hang)
+		httpserver = httptest.NewServer(noUpgrade(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == http.MethodDelete {
+				select {
+				case <-hang:
+				case <-req.Context().Done():
+				}
+				return
+			}
+			server.ServeHTTP(w, req)
+		}), false))
+		conn, err := client.DialConn(ctx, httpserver.URL, client.Options{Fallback: true, DialTimeout: 100 * time.Millisecond})
+		Expect(err).To(Succeed())
+		closed := make(chan error, 1)
+		go func() {
+			closed <- conn.Close()
+		}()
+		Eventually(closed, time.Second).Should(Receive(HaveOccurred()))
+	})
+})
@@ -0,0 +1,312 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/x12tech/go-websocketapi/apiserver"
+)
+
+// fallbackSession addresses connection of apiserver fallback transport by its token
+type fallbackSession struct {
+	url    *neturl.URL
+	token  string
+	client *http.Client
+	header http.Header
+	// ctx bounds requests waiting for packets, it is cancelled on Close
+	ctx    context.Context
+	cancel context.CancelFunc
+	// closeTimeout bounds request closing connection, it is Options.DialTimeout
+	closeTimeout time.Duration
+}
+
+func newFallbackSession(url string, opts Options) (*fallbackSession, error) {
+	parsed, err := neturl.Parse(httpURL(url))
+	if err != nil {
+		return nil, errors.Wrap(err, `parse url`)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &fallbackSession{
+		url:          parsed,
+		client:       httpClient(opts),
+		header:       opts.Header,
+		ctx:          ctx,
+		cancel:       cancel,
+		closeTimeout: opts.DialTimeout,
+	}, nil
+}
+
+func (self *fallbackSession) request(ctx context.Context, method string, query map[string]string, body []byte) (*http.Request, error) {
+	url := *self.url
+	q := url.Query()
+	for k, v := range query {
+		q.Set(k, v)
+	}
+	url.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, url.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range self.header {
+		req.Header[k] = v
+	}
+	return req, nil
+}
+
+func (self *fallbackSession) do(ctx context.Context, method string, query map[string]string, body []byte) (*http.Response, error) {
+	req, err := self.request(ctx, method, query, body)
+	if err != nil {
+		return nil, err
+	}
+	return self.client.Do(req)
+}
+
+func (self *fallbackSession) WriteMessage(ctx context.Context, buf []byte) error {
+	resp, err := self.do(ctx, http.MethodPost, map[string]string{`token`: self.token}, buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	switch resp.StatusCode {
+	case http.StatusAccepted:
+		return nil
+	case http.StatusRequestEntityTooLarge:
+		return apiserver.ErrMessageTooLarge
+	case http.StatusNotFound, http.StatusGone:
+		return ErrClosed
+	}
+	return errors.Errorf(`post packet: %s`, resp.Status)
+}
+
+func (self *fallbackSession) Close() error {
+	self.cancel()
+	ctx, cancel := context.WithTimeout(context.Background(), self.closeTimeout)
+	defer cancel()
+	resp, err := self.do(ctx, http.MethodDelete, map[string]string{`token`: self.token}, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func decodeCloseEvent(data []byte) error {
+	closeErr := new(CloseError)
+	var event struct {
+		Code   int    `json:"code"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return io.EOF
+	}
+	closeErr.Code, closeErr.Reason = event.Code, event.Reason
+	return closeErr
+}
+
+// sseTransport receives packets as Server-Sent Events and posts commands
+type sseTransport struct {
+	*fallbackSession
+	mu     sync.Mutex
+	body   io.ReadCloser
+	events *bufio.Reader
+}
+
+// sseReopenAttempts limits how many times broken stream is reopened with token before connection is given up
+const sseReopenAttempts = 3
+
+func dialSSE(ctx context.Context, url string, opts Options) (transport, error) {
+	session, err := newFallbackSession(url, opts)
+	if err != nil {
+		return nil, err
+	}
+	// stream outlives dial ctx, which only bounds waiting for open event
+	stop := context.AfterFunc(ctx, session.cancel)
+	defer stop()
+	opened := false
+	defer func() {
+		if !opened {
+			session.cancel()
+		}
+	}()
+	self := &sseTransport{fallbackSession: session}
+	if err := self.openStream(nil); err != nil {
+		return nil, err
+	}
+	event, data, err := self.readEvent()
+	if err != nil || event != `open` {
+		self.body.Close()
+		return nil, errors.Errorf(`open event expected`)
+	}
+	var open struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(data, &open); err != nil {
+		self.body.Close()
+		return nil, errors.Wrap(err, `open event`)
+	}
+	self.token = open.Token
+	opened = true
+	return self, nil
+}
+
+func (self *sseTransport) openStream(query map[string]string) error {
+	req, err := self.request(self.ctx, http.MethodGet, query, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(`Accept`, `text/event-stream`)
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get(`Content-Type`), `text/event-stream`) {
+		resp.Body.Close()
+		return errors.Errorf(`open event stream: %s`, resp.Status)
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.body = resp.Body
+	self.events = bufio.NewReader(resp.Body)
+	return nil
+}
+
+// reopen resumes broken stream of the same connection
+func (self *sseTransport) reopen() error {
+	self.mu.Lock()
+	self.body.Close()
+	self.mu.Unlock()
+	var err error
+	for attempt := 1; attempt <= sseReopenAttempts; attempt++ {
+		if err = self.openStream(map[string]string{`token`: self.token}); err == nil {
+			return nil
+		}
+		select {
+		case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+		case <-self.ctx.Done():
+			return self.ctx.Err()
+		}
+	}
+	return err
+}
+
+func (self *sseTransport) readEvent() (event string, data []byte, err error) {
+	var lines [][]byte
+	for {
+		line, err := self.events.ReadBytes('\n')
+		if err != nil {
+			return ``, nil, err
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		switch {
+		case len(line) == 0:
+			if event != `` || lines != nil {
+				return event, bytes.Join(lines, []byte("\n")), nil
+			}
+		case bytes.HasPrefix(line, []byte(`event: `)):
+			event = string(bytes.TrimPrefix(line, []byte(`event: `)))
+		case bytes.HasPrefix(line, []byte(`data: `)):
+			lines = append(lines, bytes.TrimPrefix(line, []byte(`data: `)))
+		}
+	}
+}
+
+func (self *sseTransport) ReadMessage() ([]byte, error) {
+	for {
+		event, data, err := self.readEvent()
+		if err != nil {
+			if self.ctx.Err() != nil || self.reopen() != nil {
+				return nil, io.EOF
+			}
+			continue
+		}
+		switch event {
+		case ``:
+			return data, nil
+		case `close`:
+			return nil, decodeCloseEvent(data)
+		}
+	}
+}
+
+func (self *sseTransport) Close() error {
+	err := self.fallbackSession.Close()
+	self.mu.Lock()
+	self.body.Close()
+	self.mu.Unlock()
+	return err
+}
+
+// pollTransport fetches packets with long-poll requests and posts commands
+type pollTransport struct {
+	*fallbackSession
+	queue []json.RawMessage
+}
+
+func dialPoll(ctx context.Context, url string, opts Options) (transport, error) {
+	session, err := newFallbackSession(url, opts)
+	if err != nil {
+		return nil, err
+	}
+	opened := false
+	defer func() {
+		if !opened {
+			session.cancel()
+		}
+	}()
+	resp, err := session.do(ctx, http.MethodPost, map[string]string{`transport`: `poll`}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf(`open poll: %s`, resp.Status)
+	}
+	var open struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&open); err != nil {
+		return nil, errors.Wrap(err, `open poll`)
+	}
+	session.token = open.Token
+	opened = true
+	return &pollTransport{fallbackSession: session}, nil
+}
+
+func (self *pollTransport) ReadMessage() ([]byte, error) {
+	for len(self.queue) == 0 {
+		if err := self.poll(); err != nil {
+			return nil, err
+		}
+	}
+	buf := self.queue[0]
+	self.queue = self.queue[1:]
+	return buf, nil
+}
+
+func (self *pollTransport) poll() error {
+	resp, err := self.do(self.ctx, http.MethodGet, map[string]string{`token`: self.token}, nil)
+	if err != nil {
+		return io.EOF
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return io.EOF
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return json.Unmarshal(body, &self.queue)
+	case http.StatusGone:
+		return decodeCloseEvent(body)
+	}
+	return io.EOF
+}
@@ -0,0 +1,223 @@
+package client
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/x12tech/go-websocketapi/apiserver"
+)
+
+const (
+	DefaultMinBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff = 30 * time.Second
+	DefaultJitter     = 0.5
+)
+
+type ReconnectOpts struct {
+	// MinBackoff is the delay before the first attempt, it doubles up to MaxBackoff with every failed one
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Jitter is the fraction of delay which is randomly cut off, DefaultJitter if zero
+	Jitter float64
+	// MaxAttempts closes client after so many failed attempts in a row, unlimited if zero
+	MaxAttempts int
+	// Resume restores server side state of new connection, like session, before other calls go to it.
+	// Calls made by it must use ctx passed. Connection is redialed if it fails.
+	Resume func(ctx context.Context, c *Client) error
+	// RetryCalls resends calls which were in flight when connection was lost, they fail with ErrConnectionLost otherwise
+	RetryCalls bool
+}
+
+func (self ReconnectOpts) withDefaults() ReconnectOpts {
+	if self.MinBackoff <= 0 {
+		self.MinBackoff = DefaultMinBackoff
+	}
+	if self.MaxBackoff <= 0 {
+		self.MaxBackoff = DefaultMaxBackoff
+	}
+	if self.MaxBackoff < self.MinBackoff {
+		self.MaxBackoff = self.MinBackoff
+	}
+	if self.Jitter <= 0 || self.Jitter > 1 {
+		self.Jitter = DefaultJitter
+	}
+	return self
+}
+
+// backoff is the delay before attempt counted from zero
+func (self ReconnectOpts) backoff(attempt int) time.Duration {
+	d := self.MinBackoff
+	for i := 0; i < attempt && d < self.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > self.MaxBackoff {
+		d = self.MaxBackoff
+	}
+	return d - time.Duration(self.Jitter*rand.Float64()*float64(d))
+}
+
+type resumeKey struct{}
+
+// withResume marks calls which go to connection before it is resumed
+func withResume(ctx context.Context) context.Context {
+	return context.WithValue(ctx, resumeKey{}, true)
+}
+
+func isResume(ctx context.Context) bool {
+	resume, _ := ctx.Value(resumeKey{}).(bool)
+	return resume
+}
+
+// OnReconnect registers hook run after Resume on every new connection, like resubscribing to pushes.
+// Calls made by it must use ctx passed, its error is logged.
+func (self *Client) OnReconnect(hook func(ctx context.Context) error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.hooks = append(self.hooks, hook)
+}
+
+// isFinal tells that server closed connection on purpose or refused packet of client, so it is not redialed.
+// Shutdown, timeouts and send queue overflow are redialed.
+func isFinal(err error) bool {
+	if closeErr, ok := err.(*CloseError); ok {
+		return closeErr.Code == apiserver.CloseNormal || closeErr.Code == apiserver.CloseMessageTooBig
+	}
+	return err == ErrClosed
+}
+
+// lost is called by read loop of t when it fails
+func (self *Client) lost(t transport, err error) {
+	if self.opts.Reconnect == nil || isFinal(err) {
+		self.mu.Lock()
+		current := self.transport == t
+		self.mu.Unlock()
+		if current {
+			self.fail(err)
+		}
+		return
+	}
+	detached, wasReady := self.detach(t)
+	if !detached {
+		return
+	}
+	self.opts.Logger.Println(`connection lost:`, err)
+	// loss of connection being resumed is handled by reconnect loop
+	if wasReady {
+		go self.reconnect()
+	}
+}
+
+// detach drops t if it is current transport and fails calls which are not retried,
+// wasReady tells if t was resumed already
+func (self *Client) detach(t transport) (detached, wasReady bool) {
+	self.mu.Lock()
+	if self.err != nil || self.transport != t {
+		self.mu.Unlock()
+		return false, false
+	}
+	self.transport = nil
+	if wasReady = isClosed(self.ready); wasReady {
+		self.ready = make(chan struct{})
+	}
+	for cid, c := range self.pending {
+		if c.resume || !self.opts.Reconnect.RetryCalls {
+			delete(self.pending, cid)
+			c.reply <- reply{err: ErrConnectionLost}
+		}
+	}
+	self.mu.Unlock()
+	t.Close()
+	return true, wasReady
+}
+
+func (self *Client) reconnect() {
+	opts := self.opts.Reconnect
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-time.After(opts.backoff(attempt)):
+		case <-self.done:
+			return
+		}
+		err := self.redial()
+		if err == nil {
+			return
+		}
+		self.opts.Logger.Println(`reconnect failed:`, err)
+		if opts.MaxAttempts > 0 && attempt+1 >= opts.MaxAttempts {
+			self.fail(errors.Wrap(err, `reconnect`))
+			return
+		}
+	}
+}
+
+// redial connects, resumes and runs hooks before letting calls go to the new connection
+func (self *Client) redial() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-self.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	dialCtx, dialCancel := dialContext(ctx, self.opts)
+	t, err := self.dial(dialCtx)
+	dialCancel()
+	if err != nil {
+		return err
+	}
+	self.mu.Lock()
+	if self.err != nil {
+		self.mu.Unlock()
+		t.Close()
+		return nil
+	}
+	self.transport = t
+	hooks := append([]func(context.Context) error(nil), self.hooks...)
+	self.mu.Unlock()
+	go self.readLoop(t)
+
+	resumeCtx := withResume(ctx)
+	if resume := self.opts.Reconnect.Resume; resume != nil {
+		if err := resume(resumeCtx, self); err != nil {
+			self.detach(t)
+			return errors.Wrap(err, `resume`)
+		}
+	}
+	for _, hook := range hooks {
+		if err := hook(resumeCtx); err != nil {
+			self.opts.Logger.Println(`reconnect hook failed:`, err)
+		}
+	}
+
+	// retried calls go before new ones, in order they were made
+	self.mu.Lock()
+	retry := make([]*call, 0, len(self.pending))
+	for _, c := range self.pending {
+		if !c.resume {
+			retry = append(retry, c)
+		}
+	}
+	self.mu.Unlock()
+	sort.Slice(retry, func(i, j int) bool { return retry[i].seq < retry[j].seq })
+	for _, c := range retry {
+		if err := t.WriteMessage(ctx, c.buf); err != nil {
+			self.detach(t)
+			return errors.Wrap(err, `retry`)
+		}
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.err != nil {
+		return nil
+	}
+	if self.transport != t {
+		return ErrConnectionLost
+	}
+	close(self.ready)
+	return nil
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+	"github.com/x12tech/go-websocketapi/apiserver"
+)
+
+// transport carries packets of a single connection to server
+type transport interface {
+	// ReadMessage is called by one goroutine, it returns *CloseError or io.EOF when connection is closed
+	ReadMessage() ([]byte, error)
+	WriteMessage(ctx context.Context, buf []byte) error
+	Close() error
+}
+
+// CloseError is returned when server closes connection telling why
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (self *CloseError) Error() string {
+	return `connection closed: ` + strconv.Itoa(self.Code) + ` ` + self.Reason
+}
+
+type wsTransport struct {
+	conn *gorilla.Conn
+	mu   sync.Mutex
+}
+
+func dialWs(ctx context.Context, url string, opts Options) (transport, error) {
+	dialer := gorilla.Dialer{
+		EnableCompression: opts.Compression,
+		HandshakeTimeout:  opts.DialTimeout,
+	}
+	conn, _, err := dialer.DialContext(ctx, wsURL(url), opts.Header)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadLimit(int64(opts.MaxMessageSize))
+	return &wsTransport{conn: conn}, nil
+}
+
+func (self *wsTransport) ReadMessage() ([]byte, error) {
+	_, buf, err := self.conn.ReadMessage()
+	if closeErr, ok := err.(*gorilla.CloseError); ok {
+		return nil, &CloseError{Code: closeErr.Code, Reason: closeErr.Text}
+	}
+	return buf, err
+}
+
+func (self *wsTransport) WriteMessage(ctx context.Context, buf []byte) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	deadline, _ := ctx.Deadline()
+	self.conn.SetWriteDeadline(deadline)
+	return self.conn.WriteMessage(gorilla.TextMessage, buf)
+}
+
+func (self *wsTransport) Close() error {
+	self.mu.Lock()
+	self.conn.WriteControl(gorilla.CloseMessage, gorilla.FormatCloseMessage(apiserver.CloseNormal, ``), time.Now().Add(time.Second))
+	self.mu.Unlock()
+	return self.conn.Close()
+}
+
+// streamTransport frames packets on TCP or Unix socket like apiserver.Server.Serve expects
+type streamTransport struct {
+	conn    net.Conn
+	mu      sync.Mutex
+	maxSize int
+}
+
+func dialStream(ctx context.Context, network, address string, opts Options) (transport, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &streamTransport{conn: conn, maxSize: opts.MaxMessageSize}, nil
+}
+
+func (self *streamTransport) ReadMessage() ([]byte, error) {
+	buf, err := apiserver.ReadFrame(self.conn, self.maxSize)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return buf, err
+}
+
+func (self *streamTransport) WriteMessage(ctx context.Context, buf []byte) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	deadline, _ := ctx.Deadline()
+	self.conn.SetWriteDeadline(deadline)
+	return apiserver.WriteFrame(self.conn, buf)
+}
+
+func (self *streamTransport) Close() error {
+	return self.conn.Close()
+}
+
+// wsURL and httpURL let the same server url be given with either scheme
+func wsURL(url string) string {
+	switch {
+	case strings.HasPrefix(url, `http://`):
+		return `ws://` + strings.TrimPrefix(url, `http://`)
+	case strings.HasPrefix(url, `https://`):
+		return `wss://` + strings.TrimPrefix(url, `https://`)
+	}
+	return url
+}
+
+func httpURL(url string) string {
+	switch {
+	case strings.HasPrefix(url, `ws://`):
+		return `http://` + strings.TrimPrefix(url, `ws://`)
+	case strings.HasPrefix(url, `wss://`):
+		return `https://` + strings.TrimPrefix(url, `wss://`)
+	}
+	return url
+}
+
+func httpClient(opts Options) *http.Client {
+	if opts.HTTPClient != nil {
+		return opts.HTTPClient
+	}
+	return http.DefaultClient
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net/http"
 
 	"log"
@@ -31,12 +32,8 @@ type session struct {
 	pingTime     int
 }
 
-func sessionFromConn(conn apiserver.Conn) *session {
-	return conn.Session().(*session)
-}
-
-func (commandHandler) Echo(conn apiserver.Conn, request *pingRequest) (pongResponce, error) {
-	sess := sessionFromConn(conn)
+func (commandHandler) Echo(ctx context.Context, conn apiserver.TypedConn[*session], request *pingRequest) (pongResponce, error) {
+	sess := conn.Session()
 	sess.pingTime++
 	return pongResponce{Pong: request.Ping, Times: sess.pingTime}, nil
 }
@@ -45,7 +42,7 @@ func main() {
 	handler := &commandHandler{}
 
 	router := apiserver.NewRouter()
-	router.RegisterApiHandler(0, `ping`, handler.Echo)
+	apiserver.HandleSession(router, 0, `ping`, handler.Echo)
 
 	srv, err := apiserver.NewServer(apiserver.ServerOpts{
 		Router: router,
@@ -57,5 +54,19 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	log.Println(http.ListenAndServe(`:9091`, srv))
+	// the same commands for clients which cannot hold a websocket open
+	httpHandler, err := apiserver.NewHTTPHandler(apiserver.HTTPHandlerOpts{
+		Router: router,
+		NewSessionFn: func() interface{} {
+			return new(session)
+		},
+		Sessions: apiserver.NewMemorySessionStore(apiserver.MemorySessionStoreOpts{}),
+	})
+	if err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(`/`, srv)
+	mux.Handle(`/api`, httpHandler)
+	log.Println(http.ListenAndServe(`:9091`, mux))
 }